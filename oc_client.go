@@ -2,33 +2,201 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"math/big"
 	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
-	"golang.org/x/net/proxy"
+	"github.com/706f6c6c7578/oc/ocauth"
+	"github.com/706f6c6c7578/oc/ocproto"
+	"github.com/706f6c6c7578/oc/octransport"
 )
 
-var startTime time.Time
+const (
+	outboxBaseDelay    = time.Minute
+	outboxMaxDelay     = 6 * time.Hour
+	outboxPollInterval = time.Minute
+)
+
+var (
+	startTime     time.Time
+	packetVersion int
+	transport     octransport.Config
+	outboxDir     string
+	maxAttempts   int
+	maxAge        time.Duration
+	inboxDir      string
+	authMode      string
+)
+
+// outboxEntry is the metadata of a queued message. The message itself is
+// stored next to it, in <id>.msg.
+type outboxEntry struct {
+	ID          string    `json:"id"`
+	ServerURL   string    `json:"server_url"`
+	Password    string    `json:"password"`
+	Username    string    `json:"username,omitempty"`
+	Filename    string    `json:"filename"`
+	Created     time.Time `json:"created"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+	Status      string    `json:"status"`
+}
+
+// statusError is returned by uploadData when the server answers with
+// anything other than 200 OK.
+type statusError struct {
+	code       int
+	status     string
+	body       string
+	retryAfter time.Duration // from the Retry-After header, if any
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected status: %s, body: %s", e.status, e.body)
+}
+
+// mailboxEntry is a message held for us by an oc_server mailbox.
+type mailboxEntry struct {
+	id       string
+	size     int64
+	received time.Time
+	digest   string
+	sender   string
+}
 
 func main() {
 	var username string
 	var dataFile string
 	var filename string
+	var chainFile string
+	var nodeList string
+	var hops int
 	var hideResponse bool
+	var flush, daemon, status bool
 	flag.StringVar(&username, "u", "", "Optional username")
 	flag.StringVar(&dataFile, "d", "", "File containing server addresses, ports, and passwords")
 	flag.StringVar(&filename, "f", "", "File to upload")
+	flag.StringVar(&chainFile, "c", "", "File containing the node chain (address:port password public_key)")
+	flag.StringVar(&nodeList, "l", "", "File containing the node list (nickname address:port password public_key)")
+	flag.IntVar(&hops, "n", 3, "Number of nodes to pick at random from the node list")
 	flag.BoolVar(&hideResponse, "h", false, "Hide server response")
+	flag.IntVar(&packetVersion, "V", 2, "Packet format version for node chains, 1 is the legacy minicrypt format")
+	flag.StringVar(&outboxDir, "o", "", "Outbox directory, failed sends are queued there")
+	flag.BoolVar(&flush, "flush", false, "Retry the due messages in the outbox and exit")
+	flag.BoolVar(&daemon, "daemon", false, "Keep retrying the messages in the outbox")
+	flag.BoolVar(&status, "status", false, "Show the messages in the outbox")
+	flag.IntVar(&maxAttempts, "max-attempts", 10, "Give up on a queued message after this many attempts")
+	flag.DurationVar(&maxAge, "max-age", 72*time.Hour, "Give up on a queued message after this time")
+	flag.StringVar(&inboxDir, "i", ".", "Directory for fetched messages")
+	flag.StringVar(&authMode, "auth", ocauth.ModeAuto, "Authentication: auto, challenge or password")
+	transportFlags := octransport.RegisterFlags(flag.CommandLine)
 	flag.Parse()
 
 	var err error
 
+	transport, err = transportFlags.Load()
+	if err != nil {
+		fmt.Printf("Error in transport settings: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := ocauth.CheckMode(authMode); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if packetVersion != 1 && packetVersion != 2 {
+		fmt.Println("Error: -V must be 1 or 2")
+		os.Exit(1)
+	}
+
+	if flush || daemon || status {
+		if outboxDir == "" {
+			fmt.Println("Error: -flush, -daemon and -status need an outbox directory (-o)")
+			os.Exit(1)
+		}
+		switch {
+		case status:
+			err = printOutboxStatus(outboxDir)
+		case daemon:
+			err = runDaemon(outboxDir, hideResponse)
+		default:
+			_, err = flushOutbox(outboxDir, hideResponse)
+		}
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if args := flag.Args(); len(args) > 0 && (args[0] == "list" || args[0] == "fetch" || args[0] == "delete") {
+		if len(args) < 3 || (args[0] == "delete") != (len(args) > 3) {
+			fmt.Println("Usage: oc [-i inbox] list | fetch <server_address:port> <fetch_password>\n       oc delete <server_address:port> <fetch_password> <id>...")
+			os.Exit(1)
+		}
+		serverAddress, password := args[1], args[2]
+		switch args[0] {
+		case "list":
+			err = printMailbox(serverAddress, password)
+		case "fetch":
+			err = fetchMailbox(serverAddress, password, inboxDir)
+		case "delete":
+			err = deleteMessages(serverAddress, password, args[3:])
+		}
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if chainFile != "" && nodeList != "" {
+		fmt.Println("Error: -c and -l can't be used together")
+		os.Exit(1)
+	}
+
+	var chain, nodes []ocproto.Hop
+	if chainFile != "" {
+		chain, err = readChainFile(chainFile)
+		if err != nil {
+			fmt.Printf("Error reading chain file: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if nodeList != "" {
+		nodes, err = readNodeList(nodeList)
+		if err != nil {
+			fmt.Printf("Error reading node list: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// A fresh random chain is picked for every destination
+	chainFor := func(serverAddress string) ([]ocproto.Hop, error) {
+		if nodes == nil {
+			return chain, nil
+		}
+		return selectChain(nodes, hops, stripScheme(serverAddress))
+	}
+
 	if dataFile != "" {
 		addresses, err := readDataFile(dataFile)
 		if err != nil {
@@ -37,11 +205,10 @@ func main() {
 		}
 		for _, addr := range addresses {
 			serverAddress, password := addr[0], addr[1]
-			if !strings.HasPrefix(serverAddress, "http://") && !strings.HasPrefix(serverAddress, "https://") {
-				serverAddress = "http://" + serverAddress
+			chain, err := chainFor(serverAddress)
+			if err == nil {
+				err = send(serverAddress, password, username, filename, chain, hideResponse)
 			}
-			serverURL := serverAddress + "/upload"
-			err = uploadFile(serverURL, password, username, filename, hideResponse)
 			if err != nil {
 				fmt.Printf("\nError uploading file to %s: %v\n", serverAddress, err)
 			}
@@ -49,15 +216,14 @@ func main() {
 	} else {
 		args := flag.Args()
 		if len(args) != 2 {
-			fmt.Println("Usage: oc [-u username] [-d datafile] [-h hide server response] \n          -f <filename> <server_address:port> <password>")
+			fmt.Println("Usage: oc [-u username] [-d datafile] [-c chainfile | -l nodelist [-n hops]] [-h hide server response] \n          [-o outbox] -f <filename> <server_address:port> <password>\n       oc -o outbox -flush | -daemon | -status\n       oc [-i inbox] list | fetch | delete <server_address:port> <fetch_password> [id...]")
 			os.Exit(1)
 		}
 		serverAddress, password := args[0], args[1]
-		if !strings.HasPrefix(serverAddress, "http://") && !strings.HasPrefix(serverAddress, "https://") {
-			serverAddress = "http://" + serverAddress
+		chain, err := chainFor(serverAddress)
+		if err == nil {
+			err = send(serverAddress, password, username, filename, chain, hideResponse)
 		}
-		serverURL := serverAddress + "/upload"
-		err = uploadFile(serverURL, password, username, filename, hideResponse)
 		if err != nil {
 			fmt.Printf("\nError uploading file: %v\n", err)
 			os.Exit(1)
@@ -65,6 +231,118 @@ func main() {
 	}
 }
 
+// send delivers filename to serverAddress. With a chain, the file is
+// wrapped in one encryption layer per node and posted to the first node,
+// with serverAddress as the final destination.
+func send(serverAddress, password, username, filename string, chain []ocproto.Hop, hideResponse bool) error {
+	if len(chain) == 0 {
+		if outboxDir == "" {
+			return uploadFile(uploadURL(serverAddress), password, username, filename, hideResponse)
+		}
+		content, err := os.ReadFile(filename)
+		if err != nil {
+			return fmt.Errorf("failed to read file: %w", err)
+		}
+		return deliver(uploadURL(serverAddress), password, username, filename, content, hideResponse)
+	}
+
+	message, err := os.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("failed to read file: %w", err)
+	}
+
+	destination := ocproto.Hop{Address: stripScheme(serverAddress), Password: password}
+	var onion []byte
+	if packetVersion == 1 {
+		onion, err = ocproto.BuildOnion(message, chain, destination)
+	} else {
+		onion, err = ocproto.BuildPacket(message, chain, destination)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to build onion: %w", err)
+	}
+
+	var path []string
+	for _, node := range chain {
+		name := node.Nickname
+		if name == "" {
+			name = node.Address
+		}
+		path = append(path, name)
+	}
+	fmt.Printf("Sending through %s\n", strings.Join(path, " -> "))
+	return deliver(uploadURL(chain[0].Address), chain[0].Password, username, "message.txt", onion, hideResponse)
+}
+
+// deliver uploads content and, if an outbox is used, queues it when the
+// upload failed for a reason that may go away.
+func deliver(serverURL, password, username, filename string, content []byte, hideResponse bool) error {
+	err := uploadData(serverURL, password, username, filename, bytes.NewReader(content), hideResponse)
+	if err == nil || outboxDir == "" || !retryable(err) {
+		return err
+	}
+
+	id, qerr := queueMessage(outboxDir, serverURL, password, username, filename, content, err)
+	if qerr != nil {
+		return fmt.Errorf("%w (queueing failed: %v)", err, qerr)
+	}
+	return fmt.Errorf("%w (queued in outbox as %s)", err, id)
+}
+
+// parseRetryAfter parses a Retry-After header, given in seconds or as an
+// HTTP date. It returns 0 if there is none.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && time.Until(t) > 0 {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// nextAttempt returns when a failed upload should be retried: after the
+// backoff delay, but not before the server asked for with Retry-After.
+func nextAttempt(attempts int, err error) time.Time {
+	delay := backoffDelay(attempts)
+	var se *statusError
+	if errors.As(err, &se) && se.retryAfter > 0 {
+		// Spread the clients which were sent away at the same time
+		jitter, jerr := rand.Int(rand.Reader, big.NewInt(int64(time.Minute)))
+		if jerr == nil {
+			delay = se.retryAfter + time.Duration(jitter.Int64())
+		} else {
+			delay = se.retryAfter
+		}
+	}
+	return time.Now().UTC().Add(delay)
+}
+
+// retryable reports whether a failed upload is worth another attempt.
+// Network errors and server side errors are, rejected requests are not.
+func retryable(err error) bool {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.code >= 500 || se.code == http.StatusTooManyRequests
+	}
+	return true
+}
+
+func uploadURL(serverAddress string) string {
+	if !strings.HasPrefix(serverAddress, "http://") && !strings.HasPrefix(serverAddress, "https://") {
+		serverAddress = "http://" + serverAddress
+	}
+	return serverAddress + "/upload"
+}
+
+func stripScheme(serverAddress string) string {
+	serverAddress = strings.TrimPrefix(serverAddress, "http://")
+	return strings.TrimPrefix(serverAddress, "https://")
+}
+
 func readDataFile(filename string) ([][]string, error) {
 	file, err := os.Open(filename)
 	if err != nil {
@@ -111,47 +389,167 @@ func readDataFile(filename string) ([][]string, error) {
 	return addresses, nil
 }
 
-func uploadFile(serverURL, password, username, filename string, hideResponse bool) error {
+// readChainFile reads the nodes of a chain in sending order, one per line:
+// address:port password public_key, where public_key is either the base64
+// key as published in README_public_nodes.txt or the path to a PEM file.
+func readChainFile(filename string) ([]ocproto.Hop, error) {
 	file, err := os.Open(filename)
 	if err != nil {
-		return fmt.Errorf("failed to open file: %w", err)
+		return nil, err
 	}
 	defer file.Close()
 
-	pipeReader, pipeWriter := io.Pipe()
-	writer := multipart.NewWriter(pipeWriter)
+	var chain []ocproto.Hop
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
 
-	startTime = time.Now()
-	go func() {
-		defer pipeWriter.Close()
-		defer writer.Close()
+		parts := strings.Fields(line)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("line %d: expected address:port password public_key", lineNumber)
+		}
 
-		part, err := writer.CreateFormFile("file", filename)
+		publicKey, err := ocproto.ParsePublicKey(parts[2])
 		if err != nil {
-			fmt.Printf("Error creating form file: %v\n", err)
-			return
+			return nil, fmt.Errorf("line %d: %v", lineNumber, err)
+		}
+
+		chain = append(chain, ocproto.Hop{Address: stripScheme(parts[0]), Password: parts[1], PublicKey: publicKey})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("no valid entries found in chain file")
+	}
+
+	return chain, nil
+}
+
+// readNodeList reads a node directory, one node per line:
+// nickname address:port password public_key
+func readNodeList(filename string) ([]ocproto.Hop, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var nodes []ocproto.Hop
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.Fields(line)
+		if len(parts) != 4 {
+			return nil, fmt.Errorf("line %d: expected nickname address:port password public_key", lineNumber)
 		}
 
-		_, err = io.Copy(part, file)
+		publicKey, err := ocproto.ParsePublicKey(parts[3])
 		if err != nil {
-			fmt.Printf("Error copying file content: %v\n", err)
+			return nil, fmt.Errorf("line %d: %v", lineNumber, err)
 		}
-	}()
 
-	dialer, err := proxy.SOCKS5("tcp", "localhost:9050", nil, proxy.Direct)
+		address := stripScheme(parts[1])
+		if seen[address] {
+			return nil, fmt.Errorf("line %d: duplicate node %s", lineNumber, address)
+		}
+		seen[address] = true
+
+		nodes = append(nodes, ocproto.Hop{Nickname: parts[0], Address: address, Password: parts[2], PublicKey: publicKey})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("no valid entries found in node list")
+	}
+
+	return nodes, nil
+}
+
+// selectChain picks n distinct nodes at random. The final destination is
+// never picked as a node, so it is always reached last.
+func selectChain(nodes []ocproto.Hop, n int, destination string) ([]ocproto.Hop, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("number of hops must be at least 1")
+	}
+
+	var candidates []ocproto.Hop
+	for _, node := range nodes {
+		if node.Address != destination {
+			candidates = append(candidates, node)
+		}
+	}
+	if len(candidates) < n {
+		return nil, fmt.Errorf("node list has %d usable node(s), %d requested", len(candidates), n)
+	}
+
+	// Partial Fisher-Yates shuffle
+	for i := 0; i < n; i++ {
+		j, err := rand.Int(rand.Reader, big.NewInt(int64(len(candidates)-i)))
+		if err != nil {
+			return nil, err
+		}
+		k := i + int(j.Int64())
+		candidates[i], candidates[k] = candidates[k], candidates[i]
+	}
+
+	return candidates[:n], nil
+}
+
+func uploadFile(serverURL, password, username, filename string, hideResponse bool) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	return uploadData(serverURL, password, username, filename, file, hideResponse)
+}
+
+func uploadData(serverURL, password, username, filename string, content io.Reader, hideResponse bool) error {
+	// The body is built in memory, as a challenge answer signs its digest
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("file", filename)
 	if err != nil {
-		return fmt.Errorf("can't connect to the Tor proxy: %v", err)
+		return fmt.Errorf("failed to create form file: %w", err)
+	}
+	if _, err := io.Copy(part, content); err != nil {
+		return fmt.Errorf("failed to read file content: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("failed to create form: %w", err)
 	}
-	httpTransport := &http.Transport{Dial: dialer.Dial}
-	client := &http.Client{Transport: httpTransport}
-	fmt.Println("Using Tor network")
 
-	request, err := http.NewRequest("POST", serverURL, pipeReader)
+	startTime = time.Now()
+	payload := body.Bytes()
+	request, err := http.NewRequest("POST", serverURL, bytes.NewReader(payload))
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
 	}
+	client := transport.ForMessage(request.URL.Host).HTTPClient()
+	fmt.Println(transport.Describe(request.URL.Host))
 	request.Header.Set("Content-Type", writer.FormDataContentType())
-	request.Header.Set("X-Password", password)
+	if err := ocauth.Authorize(client, request, payload, password, authMode); err != nil {
+		return err
+	}
 	if username != "" {
 		request.Header.Set("X-Username", username)
 	}
@@ -166,7 +564,12 @@ func uploadFile(serverURL, password, username, filename string, hideResponse boo
 
 	if response.StatusCode != http.StatusOK {
 		bodyBytes, _ := io.ReadAll(response.Body)
-		return fmt.Errorf("unexpected status: %s, body: %s", response.Status, string(bodyBytes))
+		return &statusError{
+			code:       response.StatusCode,
+			status:     response.Status,
+			body:       string(bodyBytes),
+			retryAfter: parseRetryAfter(response.Header.Get("Retry-After")),
+		}
 	}
 
 	elapsedTime := time.Since(startTime)
@@ -183,6 +586,410 @@ func uploadFile(serverURL, password, username, filename string, hideResponse boo
 	return nil
 }
 
+// mailboxRequest sends a request to the mailbox API of an oc_server and
+// returns the response if the status is 200 OK.
+func mailboxRequest(method, serverAddress, path, password string, query url.Values) (*http.Response, error) {
+	base := strings.TrimSuffix(uploadURL(serverAddress), "/upload")
+	var body []byte
+	target := base + path
+	if method == http.MethodGet && query != nil {
+		target += "?" + query.Encode()
+	} else if query != nil {
+		body = []byte(query.Encode())
+	}
+
+	request, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	client := transport.ForMessage(request.URL.Host).HTTPClient()
+	if err := ocauth.Authorize(client, request, body, password, authMode); err != nil {
+		return nil, err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	if response.StatusCode != http.StatusOK {
+		defer response.Body.Close()
+		bodyBytes, _ := io.ReadAll(response.Body)
+		return nil, &statusError{code: response.StatusCode, status: response.Status, body: string(bodyBytes)}
+	}
+	return response, nil
+}
+
+// listMailbox returns the messages waiting in a mailbox.
+func listMailbox(serverAddress, password string) ([]mailboxEntry, error) {
+	response, err := mailboxRequest(http.MethodGet, serverAddress, "/mailbox", password, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	var entries []mailboxEntry
+	scanner := bufio.NewScanner(response.Body)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), "\t", 5)
+		if len(parts) != 5 {
+			return nil, fmt.Errorf("invalid mailbox line %q", scanner.Text())
+		}
+		size, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid size in mailbox line %q", scanner.Text())
+		}
+		received, _ := time.Parse(time.RFC3339, parts[2])
+		entries = append(entries, mailboxEntry{id: parts[0], size: size, received: received, digest: parts[3], sender: parts[4]})
+	}
+	return entries, scanner.Err()
+}
+
+func printMailbox(serverAddress, password string) error {
+	fmt.Println(transport.Describe(stripScheme(serverAddress)))
+	entries, err := listMailbox(serverAddress, password)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		fmt.Println("Mailbox is empty")
+		return nil
+	}
+
+	for _, entry := range entries {
+		sender := entry.sender
+		if sender == "" {
+			sender = "unknown"
+		}
+		fmt.Printf("%s  %s  %d bytes  from: %s\n", entry.id, entry.received.Local().Format("2006-01-02 15:04:05"), entry.size, sender)
+	}
+	return nil
+}
+
+// fetchMailbox downloads every message of a mailbox into dir. A message
+// is only deleted on the server once its digest is verified and it is
+// safely stored.
+func fetchMailbox(serverAddress, password, dir string) error {
+	fmt.Println(transport.Describe(stripScheme(serverAddress)))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	entries, err := listMailbox(serverAddress, password)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		fmt.Println("Mailbox is empty")
+		return nil
+	}
+
+	fetched := 0
+	for _, entry := range entries {
+		name, err := fetchMessage(serverAddress, password, dir, entry)
+		if err != nil {
+			fmt.Printf("Error fetching %s: %v\n", entry.id, err)
+			continue
+		}
+		if err := deleteMessage(serverAddress, password, entry.id, entry.digest); err != nil {
+			fmt.Printf("Fetched %s as %s, but could not delete it: %v\n", entry.id, name, err)
+			continue
+		}
+		fmt.Printf("Fetched %s as %s\n", entry.id, name)
+		fetched++
+	}
+	fmt.Printf("%d of %d messages fetched\n", fetched, len(entries))
+	return nil
+}
+
+// fetchMessage downloads a message into dir and returns the name it was
+// stored under.
+func fetchMessage(serverAddress, password, dir string, entry mailboxEntry) (string, error) {
+	response, err := mailboxRequest(http.MethodGet, serverAddress, "/mailbox/fetch", password, url.Values{"id": {entry.id}})
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	content, err := io.ReadAll(response.Body)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(content)
+	if digest := hex.EncodeToString(sum[:]); digest != entry.digest || digest != response.Header.Get("X-OC-Digest") {
+		return "", errors.New("digest does not match, message not stored")
+	}
+
+	name := filepath.Base(strings.ReplaceAll(response.Header.Get("X-OC-Name"), "\\", "/"))
+	if name == "" || strings.HasPrefix(name, ".") || name == "/" {
+		name = "message"
+	}
+
+	// Never overwrite an earlier message
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		file, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if errors.Is(err, os.ErrExist) {
+			name = fmt.Sprintf("%s-%d%s", stem, i, ext)
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		_, err = file.Write(content)
+		if err == nil {
+			err = file.Sync()
+		}
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(filepath.Join(dir, name))
+			return "", err
+		}
+		return name, nil
+	}
+}
+
+func deleteMessage(serverAddress, password, id, digest string) error {
+	response, err := mailboxRequest(http.MethodPost, serverAddress, "/mailbox/delete", password, url.Values{"id": {id}, "digest": {digest}})
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+// deleteMessages deletes messages from a mailbox without fetching them.
+func deleteMessages(serverAddress, password string, ids []string) error {
+	fmt.Println(transport.Describe(stripScheme(serverAddress)))
+	entries, err := listMailbox(serverAddress, password)
+	if err != nil {
+		return err
+	}
+
+	failed := false
+	for _, id := range ids {
+		digest := ""
+		for _, entry := range entries {
+			if entry.id == id {
+				digest = entry.digest
+			}
+		}
+		if digest == "" {
+			fmt.Printf("No message %s in the mailbox\n", id)
+			failed = true
+			continue
+		}
+		if err := deleteMessage(serverAddress, password, id, digest); err != nil {
+			fmt.Printf("Error deleting %s: %v\n", id, err)
+			failed = true
+			continue
+		}
+		fmt.Printf("Deleted %s\n", id)
+	}
+	if failed {
+		return errors.New("not all messages were deleted")
+	}
+	return nil
+}
+
+func queueMessage(dir, serverURL, password, username, filename string, content []byte, sendErr error) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	randomBytes := make([]byte, 4)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", err
+	}
+	now := time.Now().UTC()
+	id := now.Format("20060102T150405") + "-" + hex.EncodeToString(randomBytes)
+
+	if err := os.WriteFile(filepath.Join(dir, id+".msg"), content, 0600); err != nil {
+		return "", err
+	}
+
+	entry := &outboxEntry{
+		ID:          id,
+		ServerURL:   serverURL,
+		Password:    password,
+		Username:    username,
+		Filename:    filename,
+		Created:     now,
+		Attempts:    1,
+		NextAttempt: nextAttempt(1, sendErr),
+		LastError:   sendErr.Error(),
+		Status:      "queued",
+	}
+	if err := saveEntry(dir, entry); err != nil {
+		os.Remove(filepath.Join(dir, id+".msg"))
+		return "", err
+	}
+	return id, nil
+}
+
+func loadOutbox(dir string) ([]*outboxEntry, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	var entries []*outboxEntry
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		entry := &outboxEntry{}
+		if err := json.Unmarshal(data, entry); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// saveEntry replaces the metadata of an entry atomically.
+func saveEntry(dir string, entry *outboxEntry) error {
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, entry.ID+".json.tmp")
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, entry.ID+".json"))
+}
+
+func removeEntry(dir string, entry *outboxEntry) error {
+	if err := os.Remove(filepath.Join(dir, entry.ID+".msg")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Remove(filepath.Join(dir, entry.ID+".json"))
+}
+
+// backoffDelay doubles the delay with every attempt, up to outboxMaxDelay,
+// and picks a random delay between half and all of it.
+func backoffDelay(attempts int) time.Duration {
+	d := outboxMaxDelay
+	if attempts < 20 {
+		d = outboxBaseDelay << (attempts - 1)
+		if d > outboxMaxDelay {
+			d = outboxMaxDelay
+		}
+	}
+
+	jitter, err := rand.Int(rand.Reader, big.NewInt(int64(d/2)))
+	if err != nil {
+		return d
+	}
+	return d/2 + time.Duration(jitter.Int64())
+}
+
+// flushOutbox retries every queued message that is due. It returns the
+// time the next queued message is due, or the zero time if none is left.
+func flushOutbox(dir string, hideResponse bool) (time.Time, error) {
+	var next time.Time
+
+	entries, err := loadOutbox(dir)
+	if err != nil {
+		return next, err
+	}
+
+	for _, entry := range entries {
+		if entry.Status != "queued" {
+			continue
+		}
+		if time.Now().Before(entry.NextAttempt) {
+			if next.IsZero() || entry.NextAttempt.Before(next) {
+				next = entry.NextAttempt
+			}
+			continue
+		}
+
+		content, err := os.ReadFile(filepath.Join(dir, entry.ID+".msg"))
+		if err != nil {
+			return next, err
+		}
+
+		fmt.Printf("Retrying %s (attempt %d)\n", entry.ID, entry.Attempts+1)
+		err = uploadData(entry.ServerURL, entry.Password, entry.Username, entry.Filename, bytes.NewReader(content), hideResponse)
+		if err == nil {
+			if err := removeEntry(dir, entry); err != nil {
+				return next, err
+			}
+			continue
+		}
+
+		fmt.Printf("\nError uploading %s: %v\n", entry.ID, err)
+		entry.Attempts++
+		entry.LastError = err.Error()
+		if !retryable(err) || entry.Attempts >= maxAttempts || time.Since(entry.Created) > maxAge {
+			entry.Status = "failed"
+			fmt.Printf("Giving up on %s after %d attempts\n", entry.ID, entry.Attempts)
+		} else {
+			entry.NextAttempt = nextAttempt(entry.Attempts, err)
+			if next.IsZero() || entry.NextAttempt.Before(next) {
+				next = entry.NextAttempt
+			}
+		}
+		if err := saveEntry(dir, entry); err != nil {
+			return next, err
+		}
+	}
+
+	return next, nil
+}
+
+// runDaemon flushes the outbox whenever a message is due. The outbox is
+// checked at least every outboxPollInterval, to pick up new messages.
+func runDaemon(dir string, hideResponse bool) error {
+	fmt.Printf("Watching outbox %s\n", dir)
+	for {
+		next, err := flushOutbox(dir, hideResponse)
+		if err != nil {
+			return err
+		}
+
+		wait := outboxPollInterval
+		if !next.IsZero() && time.Until(next) < wait {
+			wait = time.Until(next)
+		}
+		time.Sleep(wait)
+	}
+}
+
+func printOutboxStatus(dir string) error {
+	entries, err := loadOutbox(dir)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		fmt.Println("Outbox is empty")
+		return nil
+	}
+
+	for _, entry := range entries {
+		destination := entry.ServerURL
+		if u, err := url.Parse(entry.ServerURL); err == nil {
+			destination = u.Host
+		}
+		fmt.Printf("%s  %-6s  attempts: %d  to: %s\n", entry.ID, entry.Status, entry.Attempts, destination)
+		if entry.Status == "queued" {
+			fmt.Printf("    next attempt: %s\n", entry.NextAttempt.Local().Format("2006-01-02 15:04:05"))
+		}
+		if entry.LastError != "" {
+			fmt.Printf("    last error: %s\n", entry.LastError)
+		}
+	}
+	return nil
+}
+
 func formatDuration(d time.Duration) string {
 	d = d.Round(time.Second)
 	h := d / time.Hour
@@ -4,15 +4,23 @@ import (
 	"bufio"
 	"bytes"
 	"crypto/tls"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
-	"net"
 	"net/http"
+	"net/mail"
 	"net/smtp"
-	"regexp"
+	"os"
+	"os/signal"
 	"strings"
-	"golang.org/x/net/proxy"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/706f6c6c7578/oc/ocauth"
+	"github.com/706f6c6c7578/oc/ocmail"
+	"github.com/706f6c6c7578/oc/octransport"
 )
 
 const (
@@ -20,11 +28,66 @@ const (
 	defaultFrom = "Onion Courier <noreply@your.domain>"
 	host        = "smtp.your.domain"
 	port        = "2525"
-	torProxy    = "127.0.0.1:9050"
 )
 
+var (
+	transport     octransport.Config
+	allowlistPath string
+	allowed       *allowlist
+	headerList    string
+	dateMode      string
+	datePrecision time.Duration
+	policy        *ocmail.Policy
+)
+
+// allowlist holds the recipients the gateway delivers to: full addresses
+// and whole domains.
+type allowlist struct {
+	mu        sync.RWMutex
+	addresses map[string]bool
+	domains   map[string]bool
+}
+
 func main() {
-	http.HandleFunc("/upload", handleUpload)
+	flag.StringVar(&allowlistPath, "w", "", "Allowlist of recipient addresses and domains, reloaded on SIGHUP")
+	flag.StringVar(&headerList, "headers", ocmail.DefaultFields, "Comma separated header fields passed to the MTA, besides Newsgroups and References")
+	flag.StringVar(&dateMode, "date", ocmail.DateRound, "Date of delivered messages: round (down to -date-precision) or random (within -date-precision before now)")
+	flag.DurationVar(&datePrecision, "date-precision", time.Hour, "Rounding, or random range, of the Date of delivered messages")
+	transportFlags := octransport.RegisterFlags(flag.CommandLine)
+	authConfig := ocauth.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
+	var err error
+	transport, err = transportFlags.Load()
+	if err != nil {
+		log.Fatalf("Error in transport settings: %v", err)
+	}
+
+	// Message-IDs end in the domain of the default sender
+	idDomain := "localhost"
+	if addr, err := mail.ParseAddress(defaultFrom); err == nil {
+		if _, domain, ok := strings.Cut(addr.Address, "@"); ok {
+			idDomain = domain
+		}
+	}
+	policy, err = ocmail.NewPolicy(headerList, dateMode, datePrecision, idDomain)
+	if err != nil {
+		log.Fatalf("Error in header policy: %v", err)
+	}
+
+	if allowlistPath != "" {
+		allowed = &allowlist{}
+		if err := allowed.load(allowlistPath); err != nil {
+			log.Fatalf("Error reading allowlist: %v", err)
+		}
+		go reloadOnHangup()
+	} else {
+		log.Println("Warning: no allowlist (-w), every recipient is accepted")
+	}
+
+	guard := ocauth.New(*authConfig, ocauth.NewParams())
+	http.HandleFunc("/upload", guard.Handler(password, handleUpload))
+	http.HandleFunc("/challenge", guard.ServeChallenge)
 	fmt.Println("Server is running on http://localhost:8082")
 	http.ListenAndServe(":8082", nil)
 }
@@ -35,11 +98,6 @@ func handleUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if r.Header.Get("X-Password") != password {
-		http.Error(w, "Invalid password", http.StatusUnauthorized)
-		return
-	}
-
 	file, _, err := r.FormFile("file")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -53,61 +111,179 @@ func handleUpload(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Error reading file", http.StatusInternalServerError)
 		return
 	}
+	if err := ocauth.VerifyBody(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	to, customFrom, err := extractHeaders(content)
+	headers, err := ocmail.Parse(content)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	if to == "" {
-		http.Error(w, "Missing To email address", http.StatusBadRequest)
+	if len(headers.Recipients) == 0 {
+		http.Error(w, "Missing To, Cc or Bcc email address", http.StatusBadRequest)
+		return
+	}
+
+	// Check the recipients before any SMTP connection is made
+	var deliver []*mail.Address
+	var refused []refusal
+	seen := make(map[string]bool)
+	for _, addr := range headers.Recipients {
+		address := strings.ToLower(addr.Address)
+		if seen[address] {
+			continue
+		}
+		seen[address] = true
+		if allowed != nil && !allowed.allows(addr) {
+			refused = append(refused, refusal{addr, "not allowed"})
+			continue
+		}
+		deliver = append(deliver, addr)
+	}
+	if len(deliver) == 0 {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "No recipient allowed, nothing sent.\n")
+		writeReport(w, nil, refused)
 		return
 	}
 
-	fromHeader := defaultFrom
-	if customFrom != "" {
-		fromHeader = customFrom
+	// The sender's From is only used, in the header and the envelope, if
+	// the policy passes it
+	fromHeader, hasFromHeader := defaultFrom, false
+	if headers.From != "" && policy.Passes("From") {
+		fromHeader, hasFromHeader = headers.From, true
 	}
 
-	err = sendMail(content, to, fromHeader)
+	message, err := policy.Apply(content, time.Now())
+	if err != nil {
+		log.Println("Error applying header policy:", err)
+		http.Error(w, "Error applying header policy", http.StatusInternalServerError)
+		return
+	}
+	// A message without a From gets Newsgroups from To, unless it has one
+	newsgroups := ""
+	if headers.From == "" && headers.Newsgroups == "" {
+		newsgroups = headers.To
+	}
+	accepted, rejected, err := sendMail(message, deliver, newsgroups, fromHeader, hasFromHeader)
+	refused = append(refused, rejected...)
 	if err != nil {
 		log.Println("Error sending mail:", err)
-		http.Error(w, "Error sending mail: "+err.Error(), http.StatusInternalServerError)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error sending mail: %v\n", err)
+		writeReport(w, nil, refused)
 		return
 	}
 
 	fmt.Fprintf(w, "File received and sent.\nNo data is stored or logged by Onion Courier.\n")
+	writeReport(w, accepted, refused)
+}
+
+// refusal is a recipient the message was not sent to.
+type refusal struct {
+	addr   *mail.Address
+	reason string
+}
+
+// writeReport lists the accepted and refused recipients in a response.
+func writeReport(w http.ResponseWriter, accepted []*mail.Address, refused []refusal) {
+	for _, addr := range accepted {
+		fmt.Fprintf(w, "Accepted: %s\n", addr.Address)
+	}
+	for _, r := range refused {
+		fmt.Fprintf(w, "Refused: %s (%s)\n", r.addr.Address, r.reason)
+	}
+}
+
+// reloadOnHangup reloads the allowlist whenever the process gets SIGHUP.
+// A broken allowlist is reported and the old one is kept.
+func reloadOnHangup() {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		if err := allowed.load(allowlistPath); err != nil {
+			log.Printf("Error reloading allowlist, keeping the old one: %v", err)
+			continue
+		}
+		log.Println("Allowlist reloaded")
+	}
 }
 
-func extractHeaders(content []byte) (to string, from string, err error) {
-	scanner := bufio.NewScanner(bytes.NewReader(content))
-	toRe := regexp.MustCompile(`(?i)^To:\s*(.*)$`)
-	fromRe := regexp.MustCompile(`(?i)^From:\s*(.*)$`)
+// load replaces the allowlist with the entries of filename, one per line.
+// An entry with an @ is a full address, anything else a domain. Text after
+// # and a trailing comment in parentheses, like
+// "bk.ru (mail.ru anonymizer domain)", are ignored.
+func (a *allowlist) load(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
 
+	addresses := make(map[string]bool)
+	domains := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
 	for scanner.Scan() {
+		lineNumber++
 		line := scanner.Text()
-		if match := toRe.FindStringSubmatch(line); match != nil {
-			to = strings.TrimSpace(match[1])
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
 		}
-		if match := fromRe.FindStringSubmatch(line); match != nil {
-			from = strings.TrimSpace(match[1])
+		if i := strings.Index(line, "("); i >= 0 && strings.HasSuffix(strings.TrimSpace(line), ")") {
+			line = line[:i]
+		}
+		entry := strings.ToLower(strings.TrimSpace(line))
+		if entry == "" {
+			continue
+		}
+		if strings.ContainsAny(entry, " \t<>") {
+			return fmt.Errorf("line %d: invalid entry %q", lineNumber, entry)
 		}
-	}
 
+		if strings.HasPrefix(entry, "@") {
+			domains[entry[1:]] = true
+		} else if strings.Contains(entry, "@") {
+			addresses[entry] = true
+		} else {
+			domains[entry] = true
+		}
+	}
 	if err := scanner.Err(); err != nil {
-		return "", "", fmt.Errorf("error reading content: %v", err)
+		return err
 	}
 
-	return to, from, nil
+	a.mu.Lock()
+	a.addresses, a.domains = addresses, domains
+	a.mu.Unlock()
+	log.Printf("Allowlist: %d addresses, %d domains", len(addresses), len(domains))
+	return nil
+}
+
+// allows reports whether addr or its domain is on the allowlist.
+func (a *allowlist) allows(addr *mail.Address) bool {
+	address := strings.ToLower(addr.Address)
+	_, domain, _ := strings.Cut(address, "@")
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.addresses[address] || a.domains[domain]
 }
 
-func sendMail(message []byte, to string, from string) error {
-    hasFromHeader := bytes.Contains(bytes.ToLower(message), []byte("from:"))
-    
+// sendMail delivers message to the recipients and returns those the
+// server accepted and refused. It fails if none is accepted.
+func sendMail(message []byte, recipients []*mail.Address, newsgroups string, from string, hasFromHeader bool) (accepted []*mail.Address, refused []refusal, err error) {
     var headers []byte
     if !hasFromHeader {
-        headers = []byte(fmt.Sprintf("From: %s\r\nNewsgroups: %s\r\n", from, to))
+        headers = []byte(fmt.Sprintf("From: %s\r\n", from))
+        if newsgroups != "" {
+            headers = append(headers, fmt.Sprintf("Newsgroups: %s\r\n", newsgroups)...)
+        }
     }
     
     finalMessage := append(headers, message...)
@@ -121,57 +297,57 @@ func sendMail(message []byte, to string, from string) error {
         emailOnly = strings.TrimSuffix(parts[1], ">")
     }
 
-	dialer, err := proxy.SOCKS5("tcp", torProxy, nil, proxy.Direct)
-	if err != nil {
-		return fmt.Errorf("error creating SOCKS5 dialer: %v", err)
-	}
-
-	customDialer := func(network, addr string) (net.Conn, error) {
-		return dialer.Dial(network, addr)
-	}
-
 	tlsConfig := &tls.Config{
 		InsecureSkipVerify: true,
 	}
 
-	conn, err := customDialer("tcp", host+":"+port)
+	conn, err := transport.ForMessage(host).Dial("tcp", host+":"+port)
 	if err != nil {
-		return fmt.Errorf("error connecting to server: %v", err)
+		return nil, nil, fmt.Errorf("error connecting to server: %v", err)
 	}
 
 	c, err := smtp.NewClient(conn, host)
 	if err != nil {
-		return fmt.Errorf("error creating SMTP client: %v", err)
+		return nil, nil, fmt.Errorf("error creating SMTP client: %v", err)
 	}
 
 	err = c.StartTLS(tlsConfig)
 	if err != nil {
-		return fmt.Errorf("error starting TLS: %v", err)
+		return nil, nil, fmt.Errorf("error starting TLS: %v", err)
 	}
 
 	if err = c.Mail(emailOnly); err != nil {
-		return fmt.Errorf("error Mail: %v", err)
+		return nil, nil, fmt.Errorf("error Mail: %v", err)
 	}
 
-	if err = c.Rcpt(to); err != nil {
-		return fmt.Errorf("error Rcpt: %v", err)
+	// A refused recipient doesn't stop the delivery to the others
+	for _, addr := range recipients {
+		if err := c.Rcpt(addr.Address); err != nil {
+			refused = append(refused, refusal{addr, err.Error()})
+			continue
+		}
+		accepted = append(accepted, addr)
+	}
+	if len(accepted) == 0 {
+		c.Quit()
+		return nil, refused, fmt.Errorf("no recipient accepted")
 	}
 
 	w, err := c.Data()
 	if err != nil {
-		return fmt.Errorf("error Data: %v", err)
+		return nil, refused, fmt.Errorf("error Data: %v", err)
 	}
 
 	_, err = w.Write(finalMessage)
 	if err != nil {
-		return fmt.Errorf("error Write: %v", err)
+		return nil, refused, fmt.Errorf("error Write: %v", err)
 	}
 
 	err = w.Close()
 	if err != nil {
-		return fmt.Errorf("error Close: %v", err)
+		return nil, refused, fmt.Errorf("error Close: %v", err)
 	}
 
 	c.Quit()
-	return nil
+	return accepted, refused, nil
 }
\ No newline at end of file
@@ -1,40 +1,96 @@
 package main
 
 import (
+    "bufio"
     "bytes"
-    "crypto/ed25519"
-    "crypto/sha512"
-    "encoding/base64"
-    "encoding/pem"
+    "crypto/rand"
     "errors"
     "flag"
     "fmt"
-    "io"
     "io/ioutil"
     "log"
+    "math/big"
     "mime/multipart"
     "net/http"
     "os"
+    "strconv"
     "strings"
+    "sync"
+    "time"
 
+    "github.com/706f6c6c7578/oc/ocauth"
+    "github.com/706f6c6c7578/oc/ocproto"
+    "github.com/706f6c6c7578/oc/octransport"
     "github.com/awnumar/memguard"
-    "golang.org/x/crypto/chacha20poly1305"
-    "golang.org/x/crypto/curve25519"
-    "golang.org/x/net/proxy"
 )
 
 const (
     serverPassword = "secretPassword" // Set your desired server password here
     maxFileSize    = 4096 * 1024        // 4096 KB in bytes
+
+    // neutralAck is the only reply a sender gets with -ack, whatever
+    // happens to the message later on
+    neutralAck = "File received.\nNo data is stored or logged by Onion Courier.\n"
 )
 
 var (
     privateKeyPath    string
     privateKeyLocked *memguard.LockedBuffer
+    replayCachePath   string
+    replayExpiry      time.Duration
+    replays          *replayCache
+    transport         octransport.Config
+    neutralReply      bool
+    acceptLegacy      bool
+    poolEnabled       bool
+    poolInterval      time.Duration
+    poolRandom        bool
+    poolMin           int
+    poolHold          float64
+    pool              = &mixPool{}
+    guard            *ocauth.Guard
+    authMode          string
 )
 
+// mixPool holds accepted messages until a flush round, like a Mixmaster
+// pool, so the time a message leaves a node doesn't reveal when it came in.
+// Messages are kept in memory only and are lost when the node stops.
+type mixPool struct {
+    mu       sync.Mutex
+    messages []pooledMessage
+}
+
+type pooledMessage struct {
+    message      *memguard.LockedBuffer
+    onionAddress string
+    password     string
+}
+
+// replayCache remembers the digests of accepted packets until they expire,
+// so a replayed packet is not forwarded a second time. With a path, every
+// digest is appended to the file and the cache survives restarts.
+type replayCache struct {
+    mu      sync.Mutex
+    path    string
+    expiry  time.Duration
+    digests map[string]time.Time
+    file    *os.File
+}
+
 func main() {
     flag.StringVar(&privateKeyPath, "s", "", "Path to the private key file")
+    flag.StringVar(&replayCachePath, "r", "", "Path to the replay cache file (default: in memory only)")
+    flag.DurationVar(&replayExpiry, "e", 7*24*time.Hour, "Time a packet digest is kept in the replay cache")
+    flag.BoolVar(&neutralReply, "ack", true, "Reply with a neutral acknowledgement and forward in the background (-ack=false relays the next hop's response)")
+    flag.BoolVar(&acceptLegacy, "legacy", true, "Accept legacy minicrypt packets besides version 2 packets")
+    flag.BoolVar(&poolEnabled, "pool", false, "Hold messages in a mixing pool instead of forwarding them at once")
+    flag.DurationVar(&poolInterval, "pool-interval", 5*time.Minute, "Time between two pool flush rounds")
+    flag.BoolVar(&poolRandom, "pool-random", true, "Wait a random time between 0 and twice the pool interval between rounds")
+    flag.IntVar(&poolMin, "pool-min", 5, "Number of messages always kept in the pool")
+    flag.Float64Var(&poolHold, "pool-hold", 0.35, "Fraction of the pooled messages held back each round")
+    transportFlags := octransport.RegisterFlags(flag.CommandLine)
+    authConfig := ocauth.RegisterFlags(flag.CommandLine)
+    flag.StringVar(&authMode, "auth", ocauth.ModeAuto, "Authentication to the next hop: auto, challenge or password")
     flag.Parse()
 
     if privateKeyPath == "" {
@@ -42,13 +98,37 @@ func main() {
     }
 
     var err error
-    privateKeyLocked, err = loadPEM(privateKeyPath)
+    transport, err = transportFlags.Load()
+    if err != nil {
+        log.Fatalf("Error in transport settings: %v", err)
+    }
+    if err := ocauth.CheckMode(authMode); err != nil {
+        log.Fatal(err)
+    }
+
+    privateKeyLocked, err = ocproto.LoadPEM(privateKeyPath)
     if err != nil {
         log.Fatalf("Error loading private key: %v", err)
     }
     defer privateKeyLocked.Destroy()
 
-    http.HandleFunc("/upload", handleUpload)
+    replays, err = openReplayCache(replayCachePath, replayExpiry)
+    if err != nil {
+        log.Fatalf("Error opening replay cache: %v", err)
+    }
+    go replays.pruneLoop()
+
+    if poolEnabled {
+        if poolHold < 0 || poolHold >= 1 || poolMin < 0 || poolInterval <= 0 {
+            log.Fatal("Invalid pool settings: -pool-hold must be in [0, 1), -pool-min >= 0 and -pool-interval > 0")
+        }
+        go pool.flushLoop()
+    }
+
+    guard = ocauth.New(*authConfig, ocauth.NewParams())
+
+    http.HandleFunc("/upload", guard.Handler(serverPassword, handleUpload))
+    http.HandleFunc("/challenge", guard.ServeChallenge)
     fmt.Println("Server is running on http://localhost:8088")
     log.Fatal(http.ListenAndServe(":8088", nil))
 }
@@ -59,17 +139,16 @@ func handleUpload(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    if r.Header.Get("X-Password") != serverPassword {
-        http.Error(w, "Unauthorized", http.StatusUnauthorized)
-        return
-    }
-
     r.Body = http.MaxBytesReader(w, r.Body, maxFileSize)
     err := r.ParseMultipartForm(maxFileSize)
     if err != nil {
         http.Error(w, "File too large or error parsing form", http.StatusBadRequest)
         return
     }
+    if err := ocauth.VerifyBody(r); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
 
     file, _, err := r.FormFile("file")
     if err != nil {
@@ -84,45 +163,72 @@ func handleUpload(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    decryptedContent, err := decryptContent(content)
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Error decrypting content: %v", err), http.StatusInternalServerError)
-        return
-    }
-    defer decryptedContent.Destroy()
-
-    decryptedString := string(decryptedContent.Bytes())
+    var newMessage []byte
+    var next ocproto.Hop
+    if ocproto.IsPacketV2(content) {
+        newMessage, next, err = ocproto.OpenPacket(privateKeyLocked, content)
+        if err != nil {
+            http.Error(w, fmt.Sprintf("Error opening packet: %v", err), http.StatusBadRequest)
+            return
+        }
+    } else {
+        if !acceptLegacy {
+            http.Error(w, "Legacy packets are not accepted", http.StatusBadRequest)
+            return
+        }
 
-    lines := strings.Split(decryptedString, "\n")
-    var headers []string
-    var messageBody string
+        decryptedContent, err := decryptContent(content)
+        if err != nil {
+            http.Error(w, fmt.Sprintf("Error decrypting content: %v", err), http.StatusInternalServerError)
+            return
+        }
+        defer decryptedContent.Destroy()
 
-    for i, line := range lines {
-        if strings.TrimSpace(line) == "" {
-            messageBody = strings.Join(lines[i+1:], "\n")
-            break
+        next, newMessage, err = ocproto.ParseHop(decryptedContent.Bytes())
+        if errors.Is(err, ocproto.ErrNoHeaders) {
+            http.Error(w, "No valid headers found", http.StatusBadRequest)
+            return
+        }
+        if err != nil {
+            http.Error(w, "Invalid header format", http.StatusBadRequest)
+            return
         }
-        headers = append(headers, line)
     }
+    onionAddress, password := next.Address, next.Password
 
-    if len(headers) == 0 {
-        http.Error(w, "No valid headers found", http.StatusBadRequest)
+    // Only authenticated packets are remembered, so garbage can't fill the cache
+    digest, err := ocproto.PacketDigest(content)
+    if err != nil {
+        http.Error(w, "Invalid packet", http.StatusBadRequest)
         return
     }
-
-    headerParts := strings.SplitN(headers[0], " ", 3)
-    if len(headerParts) != 3 || headerParts[0] != "X-OC-To:" {
-        http.Error(w, "Invalid header format", http.StatusBadRequest)
+    fresh, err := replays.add(digest)
+    if err != nil {
+        log.Printf("Error writing replay cache: %v", err)
+        http.Error(w, "Internal server error", http.StatusInternalServerError)
+        return
+    }
+    if !fresh {
+        http.Error(w, "Duplicate packet", http.StatusConflict)
         return
     }
 
-    onionAddress := headerParts[1]
-    password := strings.TrimSpace(headerParts[2])
+    if poolEnabled {
+        pool.add(newMessage, onionAddress, password)
+        fmt.Fprint(w, neutralAck)
+        return
+    }
 
-    newMessage := strings.Join(append(headers[1:], "", messageBody), "\n")
+    if neutralReply {
+        go forward(memguard.NewBufferFromBytes(newMessage), onionAddress, password)
+        fmt.Fprint(w, neutralAck)
+        return
+    }
 
-    response, err := sendToOnionAddress([]byte(newMessage), onionAddress, password)
+    response, err := sendToOnionAddress(newMessage, onionAddress, password)
     if err != nil {
+        // The packet was not delivered, so a retry must not be a replay
+        replays.remove(digest)
         log.Printf("Error sending to onion address: %v", err)
         http.Error(w, fmt.Sprintf("Error sending to onion address: %v", err), http.StatusInternalServerError)
         return
@@ -135,17 +241,87 @@ func handleUpload(w http.ResponseWriter, r *http.Request) {
     fmt.Fprintf(w, responseMsg, response)
 }
 
-func sendToOnionAddress(message []byte, onionAddress, password string) (string, error) {
-    dialer, err := proxy.SOCKS5("tcp", "127.0.0.1:9050", nil, proxy.Direct)
+func (p *mixPool) add(message []byte, onionAddress, password string) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    p.messages = append(p.messages, pooledMessage{
+        message:      memguard.NewBufferFromBytes(message),
+        onionAddress: onionAddress,
+        password:     password,
+    })
+}
+
+func (p *mixPool) flushLoop() {
+    for {
+        wait := poolInterval
+        if poolRandom {
+            wait = randomDuration(2 * poolInterval)
+        }
+        time.Sleep(wait)
+        p.flush()
+    }
+}
+
+// flush sends a random selection of the pooled messages. At most the share
+// of the pool that is not held back is sent, and never so many that fewer
+// than poolMin messages stay in the pool.
+func (p *mixPool) flush() {
+    p.mu.Lock()
+    n := len(p.messages)
+    if n <= poolMin {
+        p.mu.Unlock()
+        return
+    }
+
+    count := int(float64(n) * (1 - poolHold))
+    if count > n-poolMin {
+        count = n - poolMin
+    }
+    if count < 1 {
+        count = 1
+    }
+
+    // Partial Fisher-Yates shuffle, the first count messages are sent
+    for i := 0; i < count; i++ {
+        j := i + randomInt(n-i)
+        p.messages[i], p.messages[j] = p.messages[j], p.messages[i]
+    }
+    outgoing := make([]pooledMessage, count)
+    copy(outgoing, p.messages[:count])
+    p.messages = append(p.messages[:0], p.messages[count:]...)
+    p.mu.Unlock()
+
+    for _, m := range outgoing {
+        go forward(m.message, m.onionAddress, m.password)
+    }
+}
+
+// forward sends a message in the background. The next hop's response is
+// dropped and failures are only written to the local log.
+func forward(message *memguard.LockedBuffer, onionAddress, password string) {
+    defer message.Destroy()
+    if _, err := sendToOnionAddress(message.Bytes(), onionAddress, password); err != nil {
+        log.Printf("Error forwarding message: %v", err)
+    }
+}
+
+func randomInt(n int) int {
+    r, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
     if err != nil {
-        return "", fmt.Errorf("error creating SOCKS5 dialer: %v", err)
+        log.Fatalf("Error reading random numbers: %v", err)
     }
+    return int(r.Int64())
+}
 
-    httpClient := &http.Client{
-        Transport: &http.Transport{
-            Dial: dialer.Dial,
-        },
+func randomDuration(max time.Duration) time.Duration {
+    if max <= 0 {
+        return 0
     }
+    return time.Duration(randomInt(int(max)))
+}
+
+func sendToOnionAddress(message []byte, onionAddress, password string) (string, error) {
+    httpClient := transport.ForMessage(onionAddress).HTTPClient()
 
     body := &bytes.Buffer{}
     writer := multipart.NewWriter(body)
@@ -164,14 +340,17 @@ func sendToOnionAddress(message []byte, onionAddress, password string) (string,
         return "", fmt.Errorf("error closing multipart writer: %v", err)
     }
 
+    payload := body.Bytes()
     url := fmt.Sprintf("http://%s/upload", onionAddress)
-    req, err := http.NewRequest("POST", url, body)
+    req, err := http.NewRequest("POST", url, bytes.NewReader(payload))
     if err != nil {
         return "", fmt.Errorf("error creating request: %v", err)
     }
 
     req.Header.Set("Content-Type", writer.FormDataContentType())
-    req.Header.Set("X-Password", password)
+    if err := ocauth.Authorize(httpClient, req, payload, password, authMode); err != nil {
+        return "", err
+    }
 
     resp, err := httpClient.Do(req)
     if err != nil {
@@ -191,88 +370,145 @@ func sendToOnionAddress(message []byte, onionAddress, password string) (string,
     return string(respBody), nil
 }
 
-func decryptContent(content []byte) (*memguard.LockedBuffer, error) {
-    reader := bytes.NewReader(content)
-    var writer bytes.Buffer
-    err := decrypt(privateKeyLocked, reader, &writer)
-    if err != nil {
-        return nil, fmt.Errorf("error decrypting: %v", err)
+func openReplayCache(path string, expiry time.Duration) (*replayCache, error) {
+    c := &replayCache{
+        path:    path,
+        expiry:  expiry,
+        digests: make(map[string]time.Time),
+    }
+    if path == "" {
+        return c, nil
     }
 
-    decryptedLocked := memguard.NewBufferFromBytes(writer.Bytes())
-    return decryptedLocked, nil
-}
-
-func loadPEM(filename string) (*memguard.LockedBuffer, error) {
-    file, err := os.Open(filename)
-    if err != nil {
+    file, err := os.Open(path)
+    if err != nil && !os.IsNotExist(err) {
         return nil, err
     }
-    defer file.Close()
-    
-    pemData, err := io.ReadAll(file)
-    if err != nil {
-        return nil, err
+    if err == nil {
+        now := time.Now()
+        scanner := bufio.NewScanner(file)
+        for scanner.Scan() {
+            parts := strings.Fields(scanner.Text())
+            if len(parts) != 2 {
+                continue
+            }
+            unix, err := strconv.ParseInt(parts[1], 10, 64)
+            if err != nil {
+                continue
+            }
+            if expires := time.Unix(unix, 0); expires.After(now) {
+                c.digests[parts[0]] = expires
+            }
+        }
+        file.Close()
+        if err := scanner.Err(); err != nil {
+            return nil, err
+        }
     }
-    
-    block, _ := pem.Decode(pemData)
-    if block == nil {
-        return nil, errors.New("PEM decoding failed")
+
+    // Drops the expired digests from the file
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if err := c.rewrite(); err != nil {
+        return nil, err
     }
-    
-    lockedBuffer := memguard.NewBufferFromBytes(block.Bytes)
-    return lockedBuffer, nil
+    return c, nil
 }
 
-func ed25519PrivateKeyToCurve25519(pk ed25519.PrivateKey) []byte {
-    h := sha512.New()
-    h.Write(pk.Seed())
-    out := h.Sum(nil)
-    return out[:curve25519.ScalarSize]
+// add records digest and reports whether it was not seen before. If the
+// digest can't be written to the file, it is not recorded at all.
+func (c *replayCache) add(digest string) (bool, error) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    now := time.Now()
+    if expires, ok := c.digests[digest]; ok && expires.After(now) {
+        return false, nil
+    }
+
+    expires := now.Add(c.expiry)
+    c.digests[digest] = expires
+    if c.file != nil {
+        if _, err := fmt.Fprintf(c.file, "%s %d\n", digest, expires.Unix()); err != nil {
+            delete(c.digests, digest)
+            return true, err
+        }
+    }
+    return true, nil
 }
 
-func decrypt(privKey *memguard.LockedBuffer, reader io.Reader, writer io.Writer) error {
-    privKeyBytes := privKey.Bytes()
-    ed25519PrivKey := ed25519.PrivateKey(privKeyBytes)
+// remove forgets digest, for a packet which was not accepted after all,
+// so the sender can retry it.
+func (c *replayCache) remove(digest string) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
 
-    curve25519PrivKey := ed25519PrivateKeyToCurve25519(ed25519PrivKey)
+    delete(c.digests, digest)
+    if err := c.rewrite(); err != nil {
+        log.Printf("Error rewriting replay cache: %v", err)
+    }
+}
 
-    curve25519PrivKeyLocked := memguard.NewBufferFromBytes(curve25519PrivKey)
-    defer curve25519PrivKeyLocked.Destroy()
+func (c *replayCache) pruneLoop() {
+    for range time.Tick(time.Hour) {
+        c.mu.Lock()
+        now := time.Now()
+        for digest, expires := range c.digests {
+            if !expires.After(now) {
+                delete(c.digests, digest)
+            }
+        }
+        if err := c.rewrite(); err != nil {
+            log.Printf("Error rewriting replay cache: %v", err)
+        }
+        c.mu.Unlock()
+    }
+}
 
-    encodedInput, err := io.ReadAll(reader)
+// rewrite replaces the cache file with the current digests. The caller
+// must hold c.mu.
+func (c *replayCache) rewrite() error {
+    if c.path == "" {
+        return nil
+    }
+
+    tmp := c.path + ".tmp"
+    file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
     if err != nil {
         return err
     }
-    decodedInput, err := base64.StdEncoding.DecodeString(string(encodedInput))
-    if err != nil {
+    writer := bufio.NewWriter(file)
+    for digest, expires := range c.digests {
+        fmt.Fprintf(writer, "%s %d\n", digest, expires.Unix())
+    }
+    if err := writer.Flush(); err != nil {
+        file.Close()
         return err
     }
-
-    curve25519EphemeralPubKey := decodedInput[:32]
-    nonce := decodedInput[32:56]
-    ciphertext := decodedInput[56:]
-
-    curve25519PrivKeyBytes := curve25519PrivKeyLocked.Bytes()
-    sharedSecret, err := curve25519.X25519(curve25519PrivKeyBytes, curve25519EphemeralPubKey)
-    if err != nil {
+    if err := file.Close(); err != nil {
         return err
     }
 
-    sharedSecretLocked := memguard.NewBufferFromBytes(sharedSecret)
-    defer sharedSecretLocked.Destroy()
-
-    sharedSecretBytes := sharedSecretLocked.Bytes()
-    aead, err := chacha20poly1305.NewX(sharedSecretBytes)
-    if err != nil {
+    if c.file != nil {
+        c.file.Close()
+        c.file = nil
+    }
+    if err := os.Rename(tmp, c.path); err != nil {
         return err
     }
+    c.file, err = os.OpenFile(c.path, os.O_APPEND|os.O_WRONLY, 0600)
+    return err
+}
 
-    plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+func decryptContent(content []byte) (*memguard.LockedBuffer, error) {
+    reader := bytes.NewReader(content)
+    var writer bytes.Buffer
+    err := ocproto.Decrypt(privateKeyLocked, reader, &writer)
     if err != nil {
-        return err
+        return nil, fmt.Errorf("error decrypting: %v", err)
     }
 
-    _, err = writer.Write(plaintext)
-    return err
+    decryptedLocked := memguard.NewBufferFromBytes(writer.Bytes())
+    return decryptedLocked, nil
 }
+
@@ -1,43 +1,255 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"mime/multipart"
 	"net/http"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/706f6c6c7578/oc/ocauth"
+	"github.com/706f6c6c7578/oc/ocdisk"
+	"github.com/706f6c6c7578/oc/ocinbox"
+	"github.com/706f6c6c7578/oc/ocproto"
+	"github.com/706f6c6c7578/oc/ocschedule"
+	"github.com/706f6c6c7578/oc/ocstore"
 )
 
 const defaultPassword = "secretPassword" // Default password
 
+// formOverhead is allowed on top of the maximum upload size for the
+// multipart encoding.
+const formOverhead = 64 * 1024
+
 var (
-	filePath string
-	password string // Now a variable to store either default or overridden password
+	filePath     string
+	password     string // Now a variable to store either default or overridden password
+	accountsFile string
+	hashPassword string
+	keyPath      string
+	maildirPath  string
+	uiAddr       string
+	fetchPass    string
+	scheduleSpec string
+	schedule     *ocschedule.Schedule // nil means always open
+	hookCommand  string
+	hookTimeout  time.Duration
+	authConfig   *ocauth.Config
+	guard        *ocauth.Guard
+	params       ocauth.Params // key derivation of all passwords
+	accounts     []*account
+
+	maxUploadFlag  string
+	totalQuotaFlag string
+	minFreeFlag    string
+	maxUploadSize  int64 // bytes, 0 means unlimited
+	totalQuota     int64 // bytes, 0 means unlimited
+	minFree        int64 // bytes, 0 means no check
 )
 
+// account is an account of the accounts file with its inbox.
+type account struct {
+	*ocstore.Account
+	box *ocinbox.Box
+}
+
 func init() {
 	flag.StringVar(&filePath, "p", "", "Path to save uploaded files")
 	flag.StringVar(&password, "o", defaultPassword, "Override default password")
+	flag.StringVar(&accountsFile, "a", "", "Accounts file")
+	flag.StringVar(&hashPassword, "hash", "", "Print the hash of a password, for the accounts file")
+	flag.StringVar(&keyPath, "s", "", "Private key to decrypt received messages")
+	flag.StringVar(&maildirPath, "maildir", "", "Maildir to deliver received messages to")
+	flag.StringVar(&uiAddr, "ui", "", "Loopback address for the web inbox, like 127.0.0.1:8079")
+	flag.StringVar(&fetchPass, "fetch", "", "Password to fetch messages through the mailbox API")
+	flag.StringVar(&hookCommand, "hook", "", "Command to run after a file is stored")
+	flag.DurationVar(&hookTimeout, "hook-timeout", time.Minute, "Maximum run time of the -hook command")
+	flag.StringVar(&scheduleSpec, "schedule", "", "Weekly opening hours, like \"Mon-Fri 15:00-21:00 UTC; Sat-Sun 11:00-21:00 UTC\"")
+	flag.StringVar(&maxUploadFlag, "m", "100M", "Maximum size of an upload, 0 for no limit")
+	flag.StringVar(&totalQuotaFlag, "q", "0", "Maximum size of all stored files, 0 for no limit")
+	flag.StringVar(&minFreeFlag, "free", "100M", "Minimum free disk space to keep, 0 for no check")
+	authConfig = ocauth.RegisterFlags(flag.CommandLine)
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s -p <path> [-o <password>]\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "  -p <path>    : Specify the path to save uploaded files (required)\n")
+		fmt.Fprintf(os.Stderr, "       %s -a <accounts file>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s -hash <password>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  -p <path>    : Specify the path to save uploaded files (required without -a)\n")
 		fmt.Fprintf(os.Stderr, "  -o <password>: Set custom password for this session (optional)\n")
+		fmt.Fprintf(os.Stderr, "  -a <file>    : Serve the accounts listed in file, one per line:\n")
+		fmt.Fprintf(os.Stderr, "                 name password_hash directory [quota=<size>] [key=<file>] [maildir=<dir>]\n")
+		fmt.Fprintf(os.Stderr, "                 [fetch=<password_hash>] [disabled]\n")
+		fmt.Fprintf(os.Stderr, "  -hash <password>: Print the password hash for the accounts file given with -a\n")
+		fmt.Fprintf(os.Stderr, "  -s <file>    : Private key to decrypt received messages (optional)\n")
+		fmt.Fprintf(os.Stderr, "  -maildir <dir>: Deliver received messages to this Maildir (optional)\n")
+		fmt.Fprintf(os.Stderr, "  -ui <address>: Serve the web inbox on this loopback address (optional)\n")
+		fmt.Fprintf(os.Stderr, "  -fetch <password>: Allow fetching messages with this password (optional)\n")
+		fmt.Fprintf(os.Stderr, "  -schedule <hours>: Only accept uploads during these weekly hours (optional)\n")
+		fmt.Fprintf(os.Stderr, "  -hook <command>: Run command after a file is stored, with OC_PATH, OC_USERNAME,\n")
+		fmt.Fprintf(os.Stderr, "                 OC_SIZE, OC_TIME and OC_ACCOUNT set (optional)\n")
+		fmt.Fprintf(os.Stderr, "  -auth-failures, -auth-window, -auth-lockout, -auth-global-failures,\n")
+		fmt.Fprintf(os.Stderr, "  -auth-global-lockout: Limits for failed password attempts\n")
+		fmt.Fprintf(os.Stderr, "  -m <size>    : Maximum size of an upload (default 100M, 0 for no limit)\n")
+		fmt.Fprintf(os.Stderr, "  -q <size>    : Maximum size of all stored files (default 0, no limit)\n")
+		fmt.Fprintf(os.Stderr, "  -free <size> : Minimum free disk space to keep (default 100M, 0 for no check)\n")
 	}
 	flag.Parse()
 
-	if filePath == "" {
+	var err error
+	for _, limit := range []struct {
+		flag  string
+		value string
+		size  *int64
+	}{
+		{"-m", maxUploadFlag, &maxUploadSize},
+		{"-q", totalQuotaFlag, &totalQuota},
+		{"-free", minFreeFlag, &minFree},
+	} {
+		*limit.size, err = ocstore.ParseSize(limit.value)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", limit.flag, err)
+			os.Exit(1)
+		}
+	}
+
+	if scheduleSpec != "" {
+		schedule, err = ocschedule.Parse(scheduleSpec)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "-schedule: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if hashPassword != "" {
+		// All hashes of an accounts file share its salt
+		p := ocauth.NewParams()
+		if accountsFile != "" {
+			p, err = ocstore.AccountsParams(accountsFile)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error reading accounts file: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		fmt.Println(p.Hash(hashPassword))
+		os.Exit(0)
+	}
+
+	if filePath == "" && accountsFile == "" {
 		flag.Usage()
 		os.Exit(1)
 	}
 }
 
 func main() {
+	if accountsFile != "" {
+		var err error
+		var list []*ocstore.Account
+		list, params, err = ocstore.ReadAccounts(accountsFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading accounts file: %v\n", err)
+			os.Exit(1)
+		}
+		for _, acc := range list {
+			accounts = append(accounts, &account{Account: acc})
+		}
+	} else {
+		params = ocauth.NewParams()
+		accounts = []*account{{Account: &ocstore.Account{Name: "default", Key: params.StoredKey(password), Dir: filePath}}}
+		if fetchPass != "" {
+			if fetchPass == password {
+				fmt.Fprintf(os.Stderr, "The -fetch password must differ from the upload password\n")
+				os.Exit(1)
+			}
+			accounts[0].FetchKey = params.StoredKey(fetchPass)
+		}
+	}
+	guard = ocauth.New(*authConfig, params)
+
+	for _, acc := range accounts {
+		if acc.KeyPath == "" {
+			acc.KeyPath = keyPath
+		}
+		if acc.KeyPath == "" {
+			continue
+		}
+		var err error
+		acc.PrivKey, err = ocproto.LoadPEM(acc.KeyPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading private key for %s: %v\n", acc.Name, err)
+			os.Exit(1)
+		}
+		defer acc.PrivKey.Destroy()
+	}
+
+	for _, acc := range accounts {
+		if acc.Maildir == "" {
+			acc.Maildir = maildirPath
+		}
+		if acc.Maildir == "" {
+			continue
+		}
+		if err := ocstore.InitMaildir(acc.Maildir); err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating Maildir for %s: %v\n", acc.Name, err)
+			os.Exit(1)
+		}
+	}
+
+	var boxes []*ocinbox.Box
+	for _, acc := range accounts {
+		acc.box = &ocinbox.Box{Name: acc.Name, Dir: acc.Dir, Maildir: acc.Maildir}
+		boxes = append(boxes, acc.box)
+	}
+
+	if uiAddr != "" {
+		if err := ocinbox.CheckLoopback(uiAddr); err != nil {
+			fmt.Fprintf(os.Stderr, "-ui: %v\n", err)
+			os.Exit(1)
+		}
+		go func() {
+			err := http.ListenAndServe(uiAddr, ocinbox.Handler(boxes))
+			fmt.Fprintf(os.Stderr, "Web inbox stopped: %v\n", err)
+		}()
+		fmt.Printf("Web inbox is running on http://%s/\n", uiAddr)
+	}
+
+	if minFree > 0 {
+		if _, err := ocdisk.Free(accounts[0].Dir); errors.Is(err, ocdisk.ErrUnsupported) {
+			fmt.Fprintf(os.Stderr, "Warning: %v, -free is ignored\n", err)
+		}
+	}
+
 	http.HandleFunc("/upload", handleUpload)
-	fmt.Printf("Server is running on http://localhost:8080\nFiles will be saved to: %s\n", filePath)
+	http.HandleFunc("/challenge", guard.ServeChallenge)
+	http.HandleFunc("/mailbox", handleMailboxList)
+	http.HandleFunc("/mailbox/fetch", handleMailboxFetch)
+	http.HandleFunc("/mailbox/delete", handleMailboxDelete)
+	fmt.Printf("Server is running on http://localhost:8080\n")
+	if schedule != nil {
+		fmt.Printf("Uploads are accepted: %s\n", scheduleSpec)
+	}
+	for _, acc := range accounts {
+		state := ""
+		if acc.PrivKey != nil {
+			state = " (decrypted)"
+		}
+		if acc.Disabled {
+			state = " (disabled)"
+		}
+		fmt.Printf("Files for %s will be saved to: %s%s\n", acc.Name, acc.Dir, state)
+		if acc.Maildir != "" {
+			fmt.Printf("Messages for %s will be delivered to: %s\n", acc.Name, acc.Maildir)
+		}
+	}
 	http.ListenAndServe(":8080", nil)
 }
 
@@ -47,21 +259,56 @@ func handleUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Outside of the opening hours clients are told when to come back
+	if now := time.Now(); schedule != nil && !schedule.Open(now) {
+		next := schedule.Next(now)
+		w.Header().Set("Retry-After", strconv.FormatInt(int64(next.Sub(now).Seconds())+1, 10))
+		http.Error(w, fmt.Sprintf("Server closed, opens again at %s", next.UTC().Format("Mon 2006-01-02 15:04 MST")), http.StatusServiceUnavailable)
+		return
+	}
+
 	// Check the password
-	if r.Header.Get("X-Password") != password {
-		http.Error(w, "Invalid password", http.StatusUnauthorized)
+	var acc *account
+	if !guard.Check(w, r, func(p ocauth.Proof) bool {
+		acc = findAccount(p)
+		return acc != nil
+	}) {
+		return
+	}
+	if acc.Disabled {
+		http.Error(w, "Account disabled", http.StatusForbidden)
 		return
 	}
 
-	file, header, err := r.FormFile("file")
+	// Storage limits are checked before and while the file is written
+	limit, status, reason, err := storageLimits(acc).Upload()
+	if err != nil {
+		http.Error(w, "Error checking storage", http.StatusInternalServerError)
+		return
+	}
+	if limit == 0 {
+		http.Error(w, reason, status)
+		return
+	}
+
+	if maxUploadSize > 0 {
+		if r.ContentLength > maxUploadSize+formOverhead {
+			http.Error(w, fmt.Sprintf("File too large, the limit is %d bytes", maxUploadSize), http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize+formOverhead)
+	}
+
+	file, err := filePart(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 	defer file.Close()
+	uploadName := file.FileName()
 
 	var filename string
-	if header.Filename == "message.txt" {
+	if uploadName == "message.txt" {
 		// Came through an Onion Courier middleman, use random filename
 		randomName, err := generateRandomFilename()
 		if err != nil {
@@ -70,38 +317,125 @@ func handleUpload(w http.ResponseWriter, r *http.Request) {
 		}
 		filename = randomName
 	} else {
-		// Use original filename
-		filename = header.Filename
+		// Use original filename, restricted to a safe character set
+		filename = ocstore.SanitizeFilename(uploadName)
 	}
 
-	// Create the destination file with the specified path and filename
-	dstPath := filepath.Join(filePath, filename)
-	dst, err := os.Create(dstPath)
+	// Create the destination file, never overwriting an existing one
+	dst, filename, err := ocstore.CreateUniqueFile(acc.Dir, filename)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Error creating file", http.StatusInternalServerError)
 		return
 	}
 	defer dst.Close()
 
-	_, err = io.Copy(dst, file)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	var reader io.Reader = file
+	if limit >= 0 {
+		reader = io.LimitReader(file, limit+1)
+	}
+	written, err := io.Copy(dst, reader)
+	if err != nil || (limit >= 0 && written > limit) {
+		dst.Close()
+		os.Remove(filepath.Join(acc.Dir, filename))
+
+		var maxBytesErr *http.MaxBytesError
+		switch {
+		case errors.As(err, &maxBytesErr):
+			http.Error(w, fmt.Sprintf("File too large, the limit is %d bytes", maxUploadSize), http.StatusRequestEntityTooLarge)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		default:
+			http.Error(w, reason, status)
+		}
 		return
 	}
 
-	// Output to stderr with timestamp and username (if provided)
-	currentTime := time.Now().Format("15:04:05")
+	// A challenge answer signs the whole request body
+	if err := ocauth.VerifyBody(r); err != nil {
+		dst.Close()
+		os.Remove(filepath.Join(acc.Dir, filename))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	received := time.Now()
 	username := r.Header.Get("X-Username")
 	if username == "" {
 		username = "Anonymous"
 	}
-	fmt.Fprintf(os.Stderr, "File %s received at %s by %s\n", filename, currentTime, username)
 
-	// Output to the client
-	if filename != header.Filename {
-		fmt.Fprintf(w, "File received and saved as %s!", filename)
+	// Messages relayed by nodes are decrypted and delivered to the
+	// Maildir, if the account has a key or a Maildir
+	stored := filename
+	if (acc.PrivKey != nil || acc.Maildir != "") && uploadName == "message.txt" {
+		dst.Close()
+		stored, err = acc.StoreMessage(filename, username, received)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Message %s for %s not delivered: %v\n", filename, acc.Name, err)
+		}
+	}
+
+	id := ocinbox.FileID(stored)
+	if name, ok := strings.CutPrefix(stored, "maildir:"); ok {
+		id = ocinbox.MaildirID(name)
+	}
+	if err := acc.box.Record(id, username, received); err != nil {
+		fmt.Fprintf(os.Stderr, "Error recording %s for %s: %v\n", stored, acc.Name, err)
+	}
+
+	// Output to stderr with timestamp and username (if provided)
+	currentTime := received.Format("15:04:05")
+	fmt.Fprintf(os.Stderr, "File %s for %s received at %s by %s\n", stored, acc.Name, currentTime, username)
+
+	if hookCommand != "" {
+		go runHook(acc, acc.StoredPath(stored), username, received)
+	}
+
+	// Output to the client. Relayed messages get a fixed acknowledgement,
+	// as their stored names tell about the host, its clock and whether
+	// decryption worked
+	if uploadName == "message.txt" {
+		fmt.Fprint(w, "Message received!")
+	} else if stored != uploadName {
+		fmt.Fprintf(w, "File received and saved as %s!", stored)
+	} else {
+		fmt.Fprintf(w, "File %s received!", stored)
+	}
+}
+
+// runHook runs the -hook command for a stored file. The command is run by
+// the shell, and learns about the file from environment variables only,
+// so senders can't inject shell code.
+func runHook(acc *account, path, username string, received time.Time) {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	var size int64
+	if info, err := os.Stat(path); err == nil {
+		size = info.Size()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", hookCommand)
 	} else {
-		fmt.Fprintf(w, "File %s received!", filename)
+		cmd = exec.CommandContext(ctx, "sh", "-c", hookCommand)
+	}
+	cmd.Env = append(os.Environ(),
+		"OC_PATH="+path,
+		"OC_USERNAME="+username,
+		"OC_SIZE="+strconv.FormatInt(size, 10),
+		"OC_TIME="+received.UTC().Format(time.RFC3339),
+		"OC_ACCOUNT="+acc.Name,
+	)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "Hook for %s failed: %v\n", path, err)
 	}
 }
 
@@ -113,3 +447,175 @@ func generateRandomFilename() (string, error) {
 	}
 	return fmt.Sprintf("m%s", hex.EncodeToString(randomBytes)[:7]), nil
 }
+
+// filePart returns the "file" part of a multipart upload. The part is
+// streamed to the caller, so nothing is buffered on disk before the
+// storage limits are applied.
+func filePart(r *http.Request) (*multipart.Part, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			if err == io.EOF {
+				return nil, errors.New("no file in upload")
+			}
+			return nil, err
+		}
+		if part.FormName() == "file" {
+			return part, nil
+		}
+		part.Close()
+	}
+}
+
+// storageLimits returns the storage limits for an upload to acc.
+func storageLimits(acc *account) ocstore.Limits {
+	limits := ocstore.Limits{
+		Quota:      acc.Quota,
+		Dirs:       acc.Dirs(),
+		TotalQuota: totalQuota,
+		MinFree:    minFree,
+		MaxUpload:  maxUploadSize,
+	}
+	if totalQuota > 0 {
+		for _, a := range accounts {
+			limits.AllDirs = append(limits.AllDirs, a.Dirs()...)
+		}
+	}
+	return limits
+}
+
+// findAccount returns the account whose password made the proof, or nil.
+// Every account is compared in constant time.
+func findAccount(p ocauth.Proof) *account {
+	var found *account
+	for _, acc := range accounts {
+		if p.Matches(acc.Key) {
+			found = acc
+		}
+	}
+	return found
+}
+
+// findMailbox returns the account whose mailbox password made the proof,
+// or nil. Like findAccount, every account is compared in constant time.
+func findMailbox(p ocauth.Proof) *account {
+	var found *account
+	for _, acc := range accounts {
+		if acc.FetchKey != nil && p.Matches(acc.FetchKey) {
+			found = acc
+		}
+	}
+	return found
+}
+
+// mailboxAccount checks the mailbox password of a request. It answers
+// the request and returns nil if there is no such mailbox.
+func mailboxAccount(w http.ResponseWriter, r *http.Request, method string) *account {
+	if r.Method != method {
+		http.Error(w, fmt.Sprintf("Only %s requests are allowed", method), http.StatusMethodNotAllowed)
+		return nil
+	}
+	var acc *account
+	if !guard.Check(w, r, func(p ocauth.Proof) bool {
+		acc = findMailbox(p)
+		return acc != nil
+	}) {
+		return nil
+	}
+	return acc
+}
+
+// handleMailboxList lists the stored messages of a mailbox, one per line:
+// id, size, arrival time, SHA-256 and sender, separated by tabs.
+func handleMailboxList(w http.ResponseWriter, r *http.Request) {
+	acc := mailboxAccount(w, r, http.MethodGet)
+	if acc == nil {
+		return
+	}
+
+	entries, err := acc.box.List()
+	if err != nil {
+		http.Error(w, "Error listing messages", http.StatusInternalServerError)
+		return
+	}
+
+	var b strings.Builder
+	for _, e := range entries {
+		digest, err := e.Digest()
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(&b, "%s\t%d\t%s\t%s\t%s\n", e.ID, e.Size, e.Received.UTC().Format(time.RFC3339), digest, e.Sender)
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, b.String())
+}
+
+// handleMailboxFetch returns a stored message, with its SHA-256 in the
+// X-OC-Digest header.
+func handleMailboxFetch(w http.ResponseWriter, r *http.Request) {
+	acc := mailboxAccount(w, r, http.MethodGet)
+	if acc == nil {
+		return
+	}
+
+	file, e, err := acc.box.Open(r.URL.Query().Get("id"))
+	if errors.Is(err, ocinbox.ErrNotFound) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error reading message", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	digest, err := e.Digest()
+	if err != nil {
+		http.Error(w, "Error reading message", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(e.Size, 10))
+	w.Header().Set("X-OC-Digest", digest)
+	w.Header().Set("X-OC-Name", e.Name)
+	io.Copy(w, file)
+}
+
+// handleMailboxDelete deletes a stored message. The client sends the
+// SHA-256 of the message it has stored, and the message is only deleted
+// if it matches.
+func handleMailboxDelete(w http.ResponseWriter, r *http.Request) {
+	acc := mailboxAccount(w, r, http.MethodPost)
+	if acc == nil {
+		return
+	}
+
+	// The form is the body a challenge answer signed
+	err := r.ParseForm()
+	if err == nil {
+		err = ocauth.VerifyBody(r)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id := r.PostFormValue("id")
+	err = acc.box.RemoveDigest(id, r.PostFormValue("digest"))
+	switch {
+	case errors.Is(err, ocinbox.ErrNotFound):
+		http.Error(w, "Message not found", http.StatusNotFound)
+	case errors.Is(err, ocinbox.ErrDigestMismatch):
+		http.Error(w, "Digest does not match, message not deleted", http.StatusConflict)
+	case err != nil:
+		http.Error(w, "Error deleting message", http.StatusInternalServerError)
+	default:
+		fmt.Fprintf(os.Stderr, "Message %s of %s deleted at %s\n", id, acc.Name, time.Now().Format("15:04:05"))
+		fmt.Fprintf(w, "Message %s deleted", id)
+	}
+}
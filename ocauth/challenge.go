@@ -0,0 +1,233 @@
+package ocauth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Headers of the challenge-response scheme, which splits keys like SCRAM
+// (RFC 5802). GET /challenge returns a nonce and the Params of the server,
+// with which the client derives
+//
+//	ClientKey = HMAC-SHA256(Argon2id(password, salt), "Client Key")
+//	StoredKey = SHA-256(ClientKey)
+//
+// and answers with
+// ClientKey XOR HMAC-SHA256(StoredKey, nonce "\n" body digest), where the
+// body digest is the hex encoded SHA-256 of the request body. The server
+// keeps only the StoredKey, which checks answers but can't make them. The
+// password never travels, and every nonce is accepted once only.
+const (
+	HeaderNonce      = "X-OC-Nonce"
+	HeaderBodyDigest = "X-OC-Body-Digest"
+	HeaderAuth       = "X-OC-Auth"
+)
+
+const (
+	nonceExpiry = 5 * time.Minute
+	maxUsed     = 10000 // used nonces remembered until they expire
+)
+
+var (
+	errNoCredentials = errors.New("no credentials")
+	errBadNonce      = errors.New("unknown or expired nonce")
+	errBusy          = errors.New("too many password checks at once")
+	errBodyDigest    = errors.New("request body does not match " + HeaderBodyDigest)
+)
+
+// signature returns the HMAC of a challenge under storedKey.
+func signature(storedKey []byte, nonce, bodyDigest string) []byte {
+	mac := hmac.New(sha256.New, storedKey)
+	io.WriteString(mac, nonce+"\n"+bodyDigest)
+	return mac.Sum(nil)
+}
+
+func xor(a, b []byte) []byte {
+	out := make([]byte, len(a))
+	subtle.XORBytes(out, a, b)
+	return out
+}
+
+// Proof is what a request offers to show it knows a password: the
+// ClientKey of a password it sent, or the answer to a challenge.
+type Proof struct {
+	clientKey  []byte
+	nonce      string
+	bodyDigest string
+	auth       []byte
+}
+
+// Matches reports, in constant time, whether the proof was made with the
+// password whose StoredKey is storedKey.
+func (p Proof) Matches(storedKey []byte) bool {
+	key := p.clientKey
+	if p.auth != nil {
+		key = xor(p.auth, signature(storedKey, p.nonce, p.bodyDigest))
+	}
+	sum := sha256.Sum256(key)
+	return subtle.ConstantTimeCompare(sum[:], storedKey) == 1
+}
+
+// nonces hands out challenges without keeping them: a nonce holds the
+// time it was issued, a random part and an HMAC over both, so only nonces
+// which were used have to be remembered, until they expire.
+type nonces struct {
+	secret []byte
+
+	mu   sync.Mutex
+	used map[string]time.Time
+}
+
+func newNonces() *nonces {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return &nonces{secret: secret, used: make(map[string]time.Time)}
+}
+
+func (n *nonces) mac(b []byte) []byte {
+	mac := hmac.New(sha256.New, n.secret)
+	mac.Write(b)
+	return mac.Sum(nil)[:16]
+}
+
+func (n *nonces) issue(now time.Time) string {
+	b := make([]byte, 8+16, 8+16+16)
+	binary.BigEndian.PutUint64(b, uint64(now.Unix()))
+	if _, err := rand.Read(b[8:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(append(b, n.mac(b)...))
+}
+
+// take uses up nonce and reports whether it was valid: issued by n, not
+// expired and not used before.
+func (n *nonces) take(nonce string, now time.Time) bool {
+	b, err := hex.DecodeString(nonce)
+	if err != nil || len(b) != 8+16+16 || !hmac.Equal(b[24:], n.mac(b[:24])) {
+		return false
+	}
+	issued := time.Unix(int64(binary.BigEndian.Uint64(b)), 0)
+	expires := issued.Add(nonceExpiry)
+	if !now.Before(expires) || issued.After(now.Add(time.Minute)) {
+		return false
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if _, ok := n.used[nonce]; ok {
+		return false
+	}
+	if len(n.used) >= maxUsed {
+		for used, until := range n.used {
+			if !now.Before(until) {
+				delete(n.used, used)
+			}
+		}
+	}
+	if len(n.used) >= maxUsed {
+		// Answers come at the pace the Guard allows, so this only
+		// happens under load; refusing is safer than forgetting
+		return false
+	}
+	n.used[nonce] = expires
+	return true
+}
+
+// ServeChallenge answers GET /challenge with a new nonce and the Params
+// of the server, separated by a space. Nothing is stored until the nonce
+// is used, so challenges can't be exhausted.
+func (g *Guard) ServeChallenge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET requests are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	nonce := g.nonces.issue(g.now())
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	io.WriteString(w, nonce+" "+g.params.String())
+}
+
+// proof returns the credentials of a request. A challenge answer uses up
+// its nonce, and the request body is checked against the signed digest
+// while it is read.
+func (g *Guard) proof(r *http.Request) (Proof, error) {
+	if auth := r.Header.Get(HeaderAuth); auth != "" {
+		p := Proof{nonce: r.Header.Get(HeaderNonce), bodyDigest: r.Header.Get(HeaderBodyDigest)}
+		var err error
+		p.auth, err = hex.DecodeString(auth)
+		if err != nil || len(p.auth) != sha256.Size || len(p.bodyDigest) != sha256.Size*2 {
+			return Proof{}, errors.New("invalid " + HeaderAuth)
+		}
+		if !g.nonces.take(p.nonce, g.now()) {
+			return Proof{}, errBadNonce
+		}
+		want, err := hex.DecodeString(p.bodyDigest)
+		if err != nil {
+			return Proof{}, errors.New("invalid " + HeaderBodyDigest)
+		}
+		r.Body = &digestBody{body: r.Body, hash: sha256.New(), want: want}
+		return p, nil
+	}
+
+	if password := r.Header.Get("X-Password"); password != "" && g.config.Legacy {
+		// The key derivation takes memory, so only a few run at once
+		select {
+		case g.kdf <- struct{}{}:
+		default:
+			return Proof{}, errBusy
+		}
+		key := g.params.clientKey(password)
+		<-g.kdf
+		return Proof{clientKey: key}, nil
+	}
+	return Proof{}, errNoCredentials
+}
+
+// digestBody fails at the end of the body if it doesn't match the digest
+// the client signed.
+type digestBody struct {
+	body io.ReadCloser
+	hash hash.Hash
+	want []byte
+	err  error
+}
+
+func (d *digestBody) Read(p []byte) (int, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	n, err := d.body.Read(p)
+	d.hash.Write(p[:n])
+	if err == io.EOF && !hmac.Equal(d.hash.Sum(nil), d.want) {
+		err = errBodyDigest
+	}
+	if err != nil {
+		d.err = err
+	}
+	return n, err
+}
+
+func (d *digestBody) Close() error {
+	return d.body.Close()
+}
+
+// VerifyBody reads the rest of the request body and returns an error if
+// it doesn't match the digest of a challenge answer. Servers call it
+// before they act on a request.
+func VerifyBody(r *http.Request) error {
+	_, err := io.Copy(io.Discard, r.Body)
+	return err
+}
@@ -0,0 +1,146 @@
+package ocauth
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newChallengeServer(t *testing.T, config Config) *httptest.Server {
+	g := New(config, testParams)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/challenge", g.ServeChallenge)
+	mux.HandleFunc("/upload", g.Handler("secret", func(w http.ResponseWriter, r *http.Request) {
+		if err := VerifyBody(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}))
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// send posts body with header and returns the status code.
+func send(t *testing.T, client *http.Client, url string, body []byte, header http.Header) int {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func authorize(t *testing.T, client *http.Client, url string, body []byte, password, mode string) http.Header {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Authorize(client, req, body, password, mode); err != nil {
+		t.Fatal(err)
+	}
+	return req.Header
+}
+
+func TestChallengeResponse(t *testing.T) {
+	server := newChallengeServer(t, DefaultConfig())
+	client := server.Client()
+	url := server.URL + "/upload"
+	body := []byte("message")
+
+	header := authorize(t, client, url, body, "secret", ModeChallenge)
+	if header.Get("X-Password") != "" {
+		t.Fatal("the password was sent")
+	}
+	if code := send(t, client, url, body, header); code != http.StatusOK {
+		t.Fatalf("got %d, want 200", code)
+	}
+	if code := send(t, client, url, body, header); code != http.StatusUnauthorized {
+		t.Errorf("replay: got %d, want 401", code)
+	}
+
+	header = authorize(t, client, url, body, "secret", ModeChallenge)
+	if code := send(t, client, url, []byte("tampered"), header); code != http.StatusBadRequest {
+		t.Errorf("tampered body: got %d, want 400", code)
+	}
+
+	header = authorize(t, client, url, body, "wrong", ModeChallenge)
+	if code := send(t, client, url, body, header); code != http.StatusUnauthorized {
+		t.Errorf("wrong password: got %d, want 401", code)
+	}
+}
+
+func TestNonces(t *testing.T) {
+	g, now := newTestGuard(DefaultConfig())
+
+	// Issuing stores nothing, so challenges can't run out
+	for i := 0; i < 2*maxUsed; i++ {
+		g.nonces.issue(g.now())
+	}
+	nonce := g.nonces.issue(g.now())
+	if !g.nonces.take(nonce, g.now()) {
+		t.Fatal("fresh nonce refused")
+	}
+	if g.nonces.take(nonce, g.now()) {
+		t.Error("used nonce accepted again")
+	}
+
+	expired := g.nonces.issue(g.now())
+	*now = now.Add(nonceExpiry)
+	if g.nonces.take(expired, g.now()) {
+		t.Error("expired nonce accepted")
+	}
+
+	other := New(DefaultConfig(), testParams)
+	if g.nonces.take(other.nonces.issue(g.now()), g.now()) {
+		t.Error("nonce of another server accepted")
+	}
+	forged := []byte(g.nonces.issue(g.now()))
+	forged[0] ^= 1
+	if g.nonces.take(string(forged), g.now()) {
+		t.Error("forged nonce accepted")
+	}
+}
+
+func TestLegacyPassword(t *testing.T) {
+	config := DefaultConfig()
+	server := newChallengeServer(t, config)
+	url := server.URL + "/upload"
+	header := http.Header{"X-Password": {"secret"}}
+	if code := send(t, server.Client(), url, nil, header); code != http.StatusOK {
+		t.Errorf("legacy password: got %d, want 200", code)
+	}
+
+	config.Legacy = false
+	server = newChallengeServer(t, config)
+	url = server.URL + "/upload"
+	if code := send(t, server.Client(), url, nil, header); code != http.StatusUnauthorized {
+		t.Errorf("legacy password with -auth-legacy=false: got %d, want 401", code)
+	}
+}
+
+func TestAuthorizeAuto(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	header := authorize(t, server.Client(), server.URL+"/upload", nil, "secret", ModeAuto)
+	if header.Get("X-Password") != "secret" || header.Get(HeaderAuth) != "" {
+		t.Error("ModeAuto did not fall back to the password")
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/upload", nil)
+	if err := Authorize(server.Client(), req, nil, "secret", ModeChallenge); err == nil {
+		t.Error("ModeChallenge fell back to the password")
+	}
+}
@@ -0,0 +1,77 @@
+package ocauth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Client modes, for the -auth flag of the programs sending to a server.
+const (
+	ModeAuto      = "auto"      // challenge-response if the server offers it
+	ModeChallenge = "challenge" // challenge-response only
+	ModePassword  = "password"  // the legacy X-Password header
+)
+
+// CheckMode returns an error if mode is not a client mode.
+func CheckMode(mode string) error {
+	switch mode {
+	case ModeAuto, ModeChallenge, ModePassword:
+		return nil
+	}
+	return fmt.Errorf("invalid auth mode %q, use auto, challenge or password", mode)
+}
+
+// Authorize adds the credentials for password to req, whose body is
+// body. In the challenge modes a nonce and the Params of the server are
+// fetched from the /challenge path of the same server with client. In
+// ModeAuto a server without challenges, which answers 404, gets the
+// password.
+func Authorize(client *http.Client, req *http.Request, body []byte, password, mode string) error {
+	if mode == ModePassword {
+		req.Header.Set("X-Password", password)
+		return nil
+	}
+
+	challengeURL := *req.URL
+	challengeURL.Path, challengeURL.RawQuery = "/challenge", ""
+	resp, err := client.Get(challengeURL.String())
+	if err != nil {
+		return fmt.Errorf("failed to get challenge: %w", err)
+	}
+	defer resp.Body.Close()
+	challenge, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return fmt.Errorf("failed to get challenge: %w", err)
+	}
+
+	if resp.StatusCode == http.StatusNotFound && mode == ModeAuto {
+		req.Header.Set("X-Password", password)
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to get challenge: %s", resp.Status)
+	}
+
+	fields := strings.Fields(string(challenge))
+	if len(fields) != 2 {
+		return fmt.Errorf("failed to get challenge: invalid response")
+	}
+	n := fields[0]
+	params, err := ParseParams(fields[1])
+	if err != nil {
+		return fmt.Errorf("failed to get challenge: %w", err)
+	}
+
+	sum := sha256.Sum256(body)
+	bodyDigest := hex.EncodeToString(sum[:])
+	req.Header.Set(HeaderNonce, n)
+	req.Header.Set(HeaderBodyDigest, bodyDigest)
+	key := params.clientKey(password)
+	storedKey := sha256.Sum256(key)
+	req.Header.Set(HeaderAuth, hex.EncodeToString(xor(key, signature(storedKey[:], n, bodyDigest))))
+	return nil
+}
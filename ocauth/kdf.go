@@ -0,0 +1,116 @@
+package ocauth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Cost of the key derivation for new Params, and the most a client
+// accepts from a server.
+const (
+	defaultTime   = 2
+	defaultMemory = 19 * 1024 // KiB
+	maxTime       = 10
+	maxMemory     = 256 * 1024
+	saltSize      = 16
+)
+
+// Params are the salt and the cost of the Argon2id key derivation of a
+// server. Clients address accounts by password alone, so all passwords of
+// a server share the Params, which GET /challenge hands out.
+type Params struct {
+	Salt   []byte
+	Time   uint32 // passes
+	Memory uint32 // KiB
+}
+
+// NewParams returns Params with a random salt and the default cost.
+func NewParams() Params {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		panic(err)
+	}
+	return Params{Salt: salt, Time: defaultTime, Memory: defaultMemory}
+}
+
+// String formats p as "argon2id:<memory>:<time>:<salt>".
+func (p Params) String() string {
+	return fmt.Sprintf("argon2id:%d:%d:%s", p.Memory, p.Time, hex.EncodeToString(p.Salt))
+}
+
+// Equal reports whether p and q derive the same keys.
+func (p Params) Equal(q Params) bool {
+	return p.Time == q.Time && p.Memory == q.Memory && bytes.Equal(p.Salt, q.Salt)
+}
+
+// ParseParams parses Params formatted by String. Params costing more than
+// a client is willing to spend are an error.
+func ParseParams(s string) (Params, error) {
+	fields := strings.Split(s, ":")
+	if len(fields) != 4 || fields[0] != "argon2id" {
+		return Params{}, fmt.Errorf("invalid key derivation %q", s)
+	}
+	memory, err1 := strconv.ParseUint(fields[1], 10, 32)
+	time, err2 := strconv.ParseUint(fields[2], 10, 32)
+	salt, err3 := hex.DecodeString(fields[3])
+	if err := errors.Join(err1, err2, err3); err != nil {
+		return Params{}, fmt.Errorf("invalid key derivation %q: %v", s, err)
+	}
+	p := Params{Salt: salt, Time: uint32(time), Memory: uint32(memory)}
+	switch {
+	case len(p.Salt) < 8:
+		return Params{}, fmt.Errorf("invalid key derivation %q: salt too short", s)
+	case p.Time < 1 || p.Time > maxTime || p.Memory < 8 || p.Memory > maxMemory:
+		return Params{}, fmt.Errorf("invalid key derivation %q: cost out of range", s)
+	}
+	return p, nil
+}
+
+// clientKey returns the ClientKey of a password.
+func (p Params) clientKey(password string) []byte {
+	salted := argon2.IDKey([]byte(password), p.Salt, p.Time, p.Memory, 1, 32)
+	mac := hmac.New(sha256.New, salted)
+	io.WriteString(mac, "Client Key")
+	return mac.Sum(nil)
+}
+
+// StoredKey returns what a server keeps of a password. It checks proofs,
+// but knowing it doesn't help to make one.
+func (p Params) StoredKey(password string) []byte {
+	sum := sha256.Sum256(p.clientKey(password))
+	return sum[:]
+}
+
+// Hash returns the Params and the StoredKey of a password, as
+// "argon2id:<memory>:<time>:<salt>:<stored key>", for files like the
+// accounts file of oc_server.
+func (p Params) Hash(password string) string {
+	return p.String() + ":" + hex.EncodeToString(p.StoredKey(password))
+}
+
+// ParseHash splits a hash made by Hash into its Params and StoredKey.
+func ParseHash(s string) (Params, []byte, error) {
+	i := strings.LastIndex(s, ":")
+	if i < 0 {
+		return Params{}, nil, fmt.Errorf("invalid password hash")
+	}
+	p, err := ParseParams(s[:i])
+	if err != nil {
+		return Params{}, nil, err
+	}
+	storedKey, err := hex.DecodeString(s[i+1:])
+	if err != nil || len(storedKey) != sha256.Size {
+		return Params{}, nil, fmt.Errorf("invalid password hash")
+	}
+	return p, storedKey, nil
+}
@@ -0,0 +1,58 @@
+package ocauth
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestHash(t *testing.T) {
+	hash := testParams.Hash("secret")
+	p, storedKey, err := ParseHash(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.Equal(testParams) || !bytes.Equal(storedKey, testParams.StoredKey("secret")) {
+		t.Errorf("ParseHash(%q) = %v, %x", hash, p, storedKey)
+	}
+
+	// The same password gets another hash with another salt
+	other := testParams
+	other.Salt = []byte("fedcba9876543210")
+	if other.Hash("secret") == hash {
+		t.Error("hashes with different salts are equal")
+	}
+
+	for _, invalid := range []string{
+		"",
+		strings.Repeat("ab", 32),
+		"argon2id:64:1:30313233343536373839616263646566",
+		"argon2id:64:1:30313233343536373839616263646566:zz",
+		"scrypt:64:1:30313233343536373839616263646566:" + strings.Repeat("ab", 32),
+	} {
+		if _, _, err := ParseHash(invalid); err == nil {
+			t.Errorf("ParseHash(%q) succeeded", invalid)
+		}
+	}
+}
+
+func TestParseParams(t *testing.T) {
+	p := NewParams()
+	parsed, err := ParseParams(p.String())
+	if err != nil || !parsed.Equal(p) {
+		t.Errorf("ParseParams(%q) = %v, %v", p.String(), parsed, err)
+	}
+
+	// A client doesn't spend more than the limits for a server
+	for _, invalid := range []string{
+		"argon2id:1048576:1:30313233343536373839616263646566",
+		"argon2id:64:100:30313233343536373839616263646566",
+		"argon2id:64:0:30313233343536373839616263646566",
+		"argon2id:64:1:00",
+		"argon2id:64:1",
+	} {
+		if _, err := ParseParams(invalid); err == nil {
+			t.Errorf("ParseParams(%q) succeeded", invalid)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+// Package ocauth protects the password checks of the Onion Courier
+// servers against brute force. Tor hides the addresses of clients, so
+// failed attempts are counted per username and for the whole server.
+// Once a limit is reached, every attempt is refused with the same 429
+// response until the lockout ends, whether the password is right or not.
+//
+// Besides the X-Password header, clients can answer a challenge, so the
+// password never travels and a replayed request fails.
+package ocauth
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxDerivations limits the password checks running the key derivation
+// at once, as each takes the memory of the Params. Passwords sent in the
+// X-Password header are refused with 429 while all slots are taken.
+const maxDerivations = 4
+
+// maxUsers limits the number of usernames tracked at once. Usernames are
+// chosen by the clients, so the global limit has to take over when there
+// are more.
+const maxUsers = 10000
+
+// Config holds the limits of a Guard.
+type Config struct {
+	MaxFailures    int           // failures per username within Window
+	Window         time.Duration // period failures are counted in
+	Lockout        time.Duration // lockout of a username
+	GlobalFailures int           // failures of all users within Window
+	GlobalLockout  time.Duration // lockout of the whole server
+	Legacy         bool          // accept the X-Password header
+}
+
+// DefaultConfig returns the limits used by RegisterFlags.
+func DefaultConfig() Config {
+	return Config{
+		MaxFailures:    5,
+		Window:         10 * time.Minute,
+		Lockout:        15 * time.Minute,
+		GlobalFailures: 30,
+		GlobalLockout:  time.Minute,
+		Legacy:         true,
+	}
+}
+
+// RegisterFlags adds -auth-failures, -auth-window, -auth-lockout,
+// -auth-global-failures, -auth-global-lockout and -auth-legacy to fs. The
+// returned Config is filled in when fs is parsed.
+func RegisterFlags(fs *flag.FlagSet) *Config {
+	c := DefaultConfig()
+	fs.IntVar(&c.MaxFailures, "auth-failures", c.MaxFailures, "Failed password attempts per username before a lockout")
+	fs.DurationVar(&c.Window, "auth-window", c.Window, "Period in which failed password attempts are counted")
+	fs.DurationVar(&c.Lockout, "auth-lockout", c.Lockout, "Lockout of a username after too many failed attempts")
+	fs.IntVar(&c.GlobalFailures, "auth-global-failures", c.GlobalFailures, "Failed password attempts of all users before a lockout")
+	fs.DurationVar(&c.GlobalLockout, "auth-global-lockout", c.GlobalLockout, "Lockout of all users after too many failed attempts")
+	fs.BoolVar(&c.Legacy, "auth-legacy", c.Legacy, "Accept passwords sent in the X-Password header, besides challenge answers")
+	return &c
+}
+
+// counter counts the failures of a username, or of all of them.
+type counter struct {
+	failures    int
+	since       time.Time
+	lockedUntil time.Time
+}
+
+// fail records a failure at now and locks the counter once limit is
+// reached. It reports whether the counter got locked.
+func (c *counter) fail(now time.Time, limit int, window, lockout time.Duration) bool {
+	if now.Sub(c.since) > window {
+		c.failures, c.since = 0, now
+	}
+	c.failures++
+	if limit > 0 && c.failures >= limit {
+		c.failures, c.since = 0, now
+		c.lockedUntil = now.Add(lockout)
+		return true
+	}
+	return false
+}
+
+// Guard throttles password checks.
+type Guard struct {
+	config Config
+	params Params
+	now    func() time.Time
+
+	nonces *nonces
+	kdf    chan struct{} // slots for key derivations
+
+	mu     sync.Mutex
+	global counter
+	users  map[string]*counter
+}
+
+// New returns a Guard with the given limits, for passwords derived with
+// params.
+func New(config Config, params Params) *Guard {
+	return &Guard{config: config, params: params, now: time.Now, nonces: newNonces(), kdf: make(chan struct{}, maxDerivations), users: make(map[string]*counter)}
+}
+
+// Check checks the credentials of a request with valid, unless the
+// username of the request, from the X-Username header, or the whole
+// server is locked out. Requests without a username, like uploads from
+// other nodes, only count towards the limit of the whole server. It
+// answers the request with 429 Too Many Requests while locked out or too
+// busy to check a password, and with 401 Unauthorized if there are no
+// valid credentials, and returns whether the request may go on. After a
+// challenge answer the server must call VerifyBody before it acts on the
+// request.
+func (g *Guard) Check(w http.ResponseWriter, r *http.Request, valid func(Proof) bool) bool {
+	username := r.Header.Get("X-Username")
+
+	if wait := g.locked(username); wait > 0 {
+		refuse(w, wait)
+		return false
+	}
+
+	// Requests without credentials, like from scanners, can't guess
+	// anything, so they don't count as failures
+	proof, err := g.proof(r)
+	if err == errNoCredentials {
+		http.Error(w, "Invalid password", http.StatusUnauthorized)
+		return false
+	}
+	if err == errBusy {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Server busy, try again later", http.StatusTooManyRequests)
+		return false
+	}
+
+	if err == nil && valid(proof) {
+		g.succeed(username)
+		return true
+	}
+
+	g.fail(username)
+	http.Error(w, "Invalid password", http.StatusUnauthorized)
+	return false
+}
+
+// Handler wraps next with Check, for servers with a single password.
+func (g *Guard) Handler(password string, next http.HandlerFunc) http.HandlerFunc {
+	key := g.params.StoredKey(password)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if g.Check(w, r, func(p Proof) bool { return p.Matches(key) }) {
+			next(w, r)
+		}
+	}
+}
+
+func refuse(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+	http.Error(w, "Too many failed attempts, try again later", http.StatusTooManyRequests)
+}
+
+// locked returns how long the username, or the server, is locked out.
+func (g *Guard) locked(username string) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.now()
+	wait := g.global.lockedUntil.Sub(now)
+	if c := g.users[username]; c != nil {
+		if d := c.lockedUntil.Sub(now); d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+func (g *Guard) succeed(username string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.users, username)
+}
+
+func (g *Guard) fail(username string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.now()
+	if g.global.fail(now, g.config.GlobalFailures, g.config.Window, g.config.GlobalLockout) {
+		log.Printf("Too many failed password attempts, all users locked out for %s", g.config.GlobalLockout)
+	}
+
+	// An empty username would be shared by all anonymous clients, so
+	// anyone could lock them out for longer than the global lockout
+	if username == "" {
+		return
+	}
+
+	c := g.users[username]
+	if c == nil {
+		if len(g.users) >= maxUsers {
+			g.prune(now)
+		}
+		if len(g.users) >= maxUsers {
+			return
+		}
+		c = &counter{since: now}
+		g.users[username] = c
+	}
+	if c.fail(now, g.config.MaxFailures, g.config.Window, g.config.Lockout) {
+		log.Printf("Too many failed password attempts for username %q, locked out for %s", username, g.config.Lockout)
+	}
+}
+
+// prune forgets the usernames which are neither locked nor have recent
+// failures.
+func (g *Guard) prune(now time.Time) {
+	for username, c := range g.users {
+		if now.After(c.lockedUntil) && now.Sub(c.since) > g.config.Window {
+			delete(g.users, username)
+		}
+	}
+}
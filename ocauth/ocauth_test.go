@@ -0,0 +1,156 @@
+package ocauth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testParams make the key derivation cheap, for tests only.
+var testParams = Params{Salt: []byte("0123456789abcdef"), Time: 1, Memory: 64}
+
+func TestProofMatches(t *testing.T) {
+	key := testParams.StoredKey("secret")
+	if !(Proof{clientKey: testParams.clientKey("secret")}).Matches(key) {
+		t.Error("password proof did not match")
+	}
+	for _, given := range []string{"", "secre", "secret!", "Secret"} {
+		if (Proof{clientKey: testParams.clientKey(given)}).Matches(key) {
+			t.Errorf("password proof %q matched", given)
+		}
+	}
+
+	// The StoredKey, as kept by a server, can't answer a challenge
+	digest := strings.Repeat("0", 64)
+	stolen := Proof{nonce: "nonce", bodyDigest: digest, auth: signature(key, "nonce", digest)}
+	if stolen.Matches(key) {
+		t.Error("proof made with the StoredKey matched")
+	}
+	stolen.auth = key
+	if stolen.Matches(key) {
+		t.Error("the StoredKey itself matched")
+	}
+
+	ck := testParams.clientKey("secret")
+	answer := Proof{nonce: "nonce", bodyDigest: digest, auth: xor(ck, signature(key, "nonce", digest))}
+	if !answer.Matches(key) {
+		t.Error("challenge answer did not match")
+	}
+}
+
+func newTestGuard(config Config) (*Guard, *time.Time) {
+	g := New(config, testParams)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	g.now = func() time.Time { return now }
+	return g, &now
+}
+
+func attempt(g *Guard, username, password string) int {
+	handler := g.Handler("secret", func(w http.ResponseWriter, r *http.Request) {})
+	r := httptest.NewRequest(http.MethodPost, "/upload", nil)
+	r.Header.Set("X-Username", username)
+	r.Header.Set("X-Password", password)
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w.Code
+}
+
+func TestUserLockout(t *testing.T) {
+	config := DefaultConfig()
+	config.GlobalFailures = 0
+	g, now := newTestGuard(config)
+
+	for i := 0; i < config.MaxFailures; i++ {
+		if code := attempt(g, "alice", "wrong"); code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: got %d, want 401", i+1, code)
+		}
+	}
+	if code := attempt(g, "alice", "secret"); code != http.StatusTooManyRequests {
+		t.Errorf("locked user with right password: got %d, want 429", code)
+	}
+	if code := attempt(g, "bob", "secret"); code != http.StatusOK {
+		t.Errorf("other user: got %d, want 200", code)
+	}
+
+	*now = now.Add(config.Lockout + time.Second)
+	if code := attempt(g, "alice", "secret"); code != http.StatusOK {
+		t.Errorf("after the lockout: got %d, want 200", code)
+	}
+}
+
+func TestGlobalLockout(t *testing.T) {
+	config := DefaultConfig()
+	g, now := newTestGuard(config)
+
+	// Every attempt uses another username, like a brute force would
+	for i := 0; i < config.GlobalFailures; i++ {
+		attempt(g, string(rune('a'+i%26))+string(rune('a'+i/26)), "wrong")
+	}
+	if code := attempt(g, "bob", "secret"); code != http.StatusTooManyRequests {
+		t.Errorf("during the global lockout: got %d, want 429", code)
+	}
+
+	*now = now.Add(config.GlobalLockout + time.Second)
+	if code := attempt(g, "bob", "secret"); code != http.StatusOK {
+		t.Errorf("after the global lockout: got %d, want 200", code)
+	}
+}
+
+func TestAnonymousFailures(t *testing.T) {
+	config := DefaultConfig()
+	g, now := newTestGuard(config)
+
+	// Requests without a username only count towards the global limit
+	for i := 0; i < config.MaxFailures; i++ {
+		attempt(g, "", "wrong")
+	}
+	if code := attempt(g, "", "secret"); code != http.StatusOK {
+		t.Errorf("anonymous after %d failures: got %d, want 200", config.MaxFailures, code)
+	}
+
+	for i := 0; i < config.GlobalFailures; i++ {
+		attempt(g, "", "wrong")
+	}
+	if code := attempt(g, "", "secret"); code != http.StatusTooManyRequests {
+		t.Errorf("anonymous during the global lockout: got %d, want 429", code)
+	}
+	*now = now.Add(config.GlobalLockout + time.Second)
+	if code := attempt(g, "", "secret"); code != http.StatusOK {
+		t.Errorf("anonymous after the global lockout: got %d, want 200", code)
+	}
+}
+
+func TestDerivationsLimited(t *testing.T) {
+	g, _ := newTestGuard(DefaultConfig())
+
+	for i := 0; i < maxDerivations; i++ {
+		g.kdf <- struct{}{}
+	}
+	for i := 0; i < 2*g.config.GlobalFailures; i++ {
+		if code := attempt(g, "alice", "secret"); code != http.StatusTooManyRequests {
+			t.Fatalf("all slots taken: got %d, want 429", code)
+		}
+	}
+	for i := 0; i < maxDerivations; i++ {
+		<-g.kdf
+	}
+	// Busy answers are not failures
+	if code := attempt(g, "alice", "secret"); code != http.StatusOK {
+		t.Errorf("free slot: got %d, want 200", code)
+	}
+}
+
+func TestFailuresExpire(t *testing.T) {
+	config := DefaultConfig()
+	g, now := newTestGuard(config)
+
+	for i := 0; i < config.MaxFailures-1; i++ {
+		attempt(g, "alice", "wrong")
+	}
+	*now = now.Add(config.Window + time.Second)
+	if code := attempt(g, "alice", "wrong"); code != http.StatusUnauthorized {
+		t.Errorf("got %d, want 401 as older failures expired", code)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package ocdisk
+
+// Free always fails with ErrUnsupported on this system.
+func Free(path string) (uint64, error) {
+	return 0, ErrUnsupported
+}
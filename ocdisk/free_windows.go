@@ -0,0 +1,19 @@
+//go:build windows
+
+package ocdisk
+
+import "golang.org/x/sys/windows"
+
+// Free returns the number of bytes available to the user on the volume
+// holding path.
+func Free(path string) (uint64, error) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var available, total, free uint64
+	if err := windows.GetDiskFreeSpaceEx(p, &available, &total, &free); err != nil {
+		return 0, err
+	}
+	return available, nil
+}
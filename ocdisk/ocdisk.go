@@ -0,0 +1,9 @@
+// Package ocdisk reports the free space of a file system, for the storage
+// limits of oc_server.
+package ocdisk
+
+import "errors"
+
+// ErrUnsupported is returned by Free on systems where the free space
+// can't be determined.
+var ErrUnsupported = errors.New("free disk space is not supported on this system")
@@ -0,0 +1,311 @@
+// Package ocinbox reads the storage oc_server writes: the files of an
+// account, its undecrypted subdirectory and its Maildir. Senders and
+// arrival times come from a hidden index log, as the files themselves
+// don't carry them.
+package ocinbox
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IndexFile is the index log in the directory of a Box. Every line holds
+// the arrival time, the entry ID and the sender, separated by tabs.
+const IndexFile = ".oc_received.log"
+
+// ErrNotFound is returned for IDs which don't name an entry of a Box.
+var ErrNotFound = errors.New("message not found")
+
+// ErrDigestMismatch is returned by RemoveDigest if the entry isn't the
+// one the caller has seen.
+var ErrDigestMismatch = errors.New("message digest does not match")
+
+// Box is the storage of one account.
+type Box struct {
+	Name    string
+	Dir     string // stored files
+	Maildir string // optional
+
+	mu sync.Mutex // guards the index log
+}
+
+// Entry is a received file or message.
+type Entry struct {
+	ID       string // "files/<path>" or "maildir/<new|cur>/<name>"
+	Name     string
+	Sender   string // empty if unknown
+	Received time.Time
+	Size     int64
+	New      bool // not yet seen by a Maildir reader
+
+	path string
+}
+
+// FileID returns the ID of the file stored as rel in the directory of a
+// Box.
+func FileID(rel string) string {
+	return "files/" + filepath.ToSlash(rel)
+}
+
+// MaildirID returns the ID of a message delivered to the new directory of
+// the Maildir of a Box.
+func MaildirID(name string) string {
+	return "maildir/new/" + name
+}
+
+// indexKey identifies an entry in the index log. Maildir readers move
+// messages from new to cur and append flags to their names, so only the
+// unique part of the name is used.
+func indexKey(id string) string {
+	if rest, ok := strings.CutPrefix(id, "maildir/"); ok {
+		name := path.Base(rest)
+		if i := strings.Index(name, ":"); i >= 0 {
+			name = name[:i]
+		}
+		return "maildir/" + name
+	}
+	return id
+}
+
+// Record appends an entry to the index log.
+func (b *Box) Record(id, sender string, received time.Time) error {
+	sender = strings.Map(func(r rune) rune {
+		if r == '\t' || r == '\r' || r == '\n' {
+			return ' '
+		}
+		return r
+	}, sender)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	file, err := os.OpenFile(filepath.Join(b.Dir, IndexFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(file, "%s\t%s\t%s\n", received.UTC().Format(time.RFC3339), id, sender)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+type indexEntry struct {
+	sender   string
+	received time.Time
+}
+
+// readIndex returns the index log by key. A missing log is empty.
+func (b *Box) readIndex() (map[string]indexEntry, error) {
+	index := make(map[string]indexEntry)
+	file, err := os.Open(filepath.Join(b.Dir, IndexFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), "\t", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		received, err := time.Parse(time.RFC3339, parts[0])
+		if err != nil {
+			continue
+		}
+		index[indexKey(parts[1])] = indexEntry{sender: parts[2], received: received}
+	}
+	return index, scanner.Err()
+}
+
+// List returns the entries of the Box, newest first.
+func (b *Box) List() ([]Entry, error) {
+	b.mu.Lock()
+	index, err := b.readIndex()
+	b.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+	add := func(id, p string, info fs.FileInfo, isNew bool) {
+		e := Entry{ID: id, Name: info.Name(), Received: info.ModTime(), Size: info.Size(), New: isNew, path: p}
+		if known, ok := index[indexKey(id)]; ok {
+			e.Sender = known.sender
+			e.Received = known.received
+		}
+		entries = append(entries, e)
+	}
+
+	err = filepath.WalkDir(b.Dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == b.Dir {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") || (b.Maildir != "" && filepath.Clean(p) == filepath.Clean(b.Maildir)) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(b.Dir, p)
+		if err != nil {
+			return err
+		}
+		add(FileID(rel), p, info, false)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if b.Maildir != "" {
+		for _, sub := range []string{"new", "cur"} {
+			files, err := os.ReadDir(filepath.Join(b.Maildir, sub))
+			if err != nil {
+				return nil, err
+			}
+			for _, f := range files {
+				if strings.HasPrefix(f.Name(), ".") || !f.Type().IsRegular() {
+					continue
+				}
+				info, err := f.Info()
+				if err != nil {
+					return nil, err
+				}
+				add("maildir/"+sub+"/"+f.Name(), filepath.Join(b.Maildir, sub, f.Name()), info, sub == "new")
+			}
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Received.After(entries[j].Received)
+	})
+	return entries, nil
+}
+
+// Find returns the entry with the given ID. Only IDs returned by List are
+// found, so an ID can't name a file outside of the Box.
+func (b *Box) Find(id string) (Entry, error) {
+	entries, err := b.List()
+	if err != nil {
+		return Entry{}, err
+	}
+	for _, e := range entries {
+		if e.ID == id {
+			return e, nil
+		}
+	}
+	return Entry{}, ErrNotFound
+}
+
+// Open opens the entry with the given ID for reading.
+func (b *Box) Open(id string) (*os.File, Entry, error) {
+	e, err := b.Find(id)
+	if err != nil {
+		return nil, Entry{}, err
+	}
+	file, err := os.Open(e.path)
+	return file, e, err
+}
+
+// Remove deletes the entry with the given ID and its line in the index
+// log.
+func (b *Box) Remove(id string) error {
+	e, err := b.Find(id)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(e.path); err != nil {
+		return err
+	}
+	return b.forget(indexKey(id))
+}
+
+// RemoveDigest deletes the entry with the given ID like Remove, but only
+// if the hex encoded SHA-256 of its content is digest. Clients use it to
+// delete a message only after they have stored it.
+func (b *Box) RemoveDigest(id, digest string) error {
+	e, err := b.Find(id)
+	if err != nil {
+		return err
+	}
+	sum, err := e.Digest()
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(sum, digest) {
+		return ErrDigestMismatch
+	}
+	return b.Remove(id)
+}
+
+// Digest returns the hex encoded SHA-256 of the content of e.
+func (e Entry) Digest() (string, error) {
+	file, err := os.Open(e.path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// forget rewrites the index log without key.
+func (b *Box) forget(key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	indexPath := filepath.Join(b.Dir, IndexFile)
+	data, err := os.ReadFile(indexPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var kept strings.Builder
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		parts := strings.SplitN(line, "\t", 3)
+		if len(parts) == 3 && indexKey(parts[1]) == key {
+			continue
+		}
+		kept.WriteString(line)
+	}
+
+	tmpPath := indexPath + ".tmp"
+	if err := os.WriteFile(tmpPath, []byte(kept.String()), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, indexPath)
+}
@@ -0,0 +1,223 @@
+package ocinbox
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testMaildirName = "1714564800.M1P2Q3Rabcdef.host"
+
+// testBox returns a Box with two files, one of them in a subdirectory, and
+// a Maildir below its directory with a message in new.
+func testBox(t *testing.T) *Box {
+	t.Helper()
+	root := t.TempDir()
+	b := &Box{Name: "alice", Dir: filepath.Join(root, "files")}
+	b.Maildir = filepath.Join(b.Dir, "Maildir")
+
+	for name, content := range map[string]string{
+		"a.txt":                          "first",
+		"undecrypted/b":                  "second",
+		".hidden":                        "hidden",
+		"Maildir/tmp/partial":            "partial",
+		"Maildir/new/" + testMaildirName: "message",
+		"Maildir/cur/.hidden":            "hidden",
+		"../outside.txt":                 "outside",
+	} {
+		p := filepath.Join(b.Dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return b
+}
+
+// ids returns the IDs of entries.
+func ids(entries []Entry) []string {
+	var result []string
+	for _, e := range entries {
+		result = append(result, e.ID)
+	}
+	return result
+}
+
+func digest(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestIndexKey(t *testing.T) {
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{"files/a.txt", "files/a.txt"},
+		{"files/undecrypted/b", "files/undecrypted/b"},
+		{"maildir/new/" + testMaildirName, "maildir/" + testMaildirName},
+		{"maildir/cur/" + testMaildirName, "maildir/" + testMaildirName},
+		{"maildir/cur/" + testMaildirName + ":2,S", "maildir/" + testMaildirName},
+		{"maildir/cur/" + testMaildirName + ":2,RS", "maildir/" + testMaildirName},
+	}
+	for _, test := range tests {
+		if got := indexKey(test.id); got != test.want {
+			t.Errorf("indexKey(%q) = %q, want %q", test.id, got, test.want)
+		}
+	}
+}
+
+func TestList(t *testing.T) {
+	b := testBox(t)
+	early := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	if err := b.Record(FileID("a.txt"), "bob\tthe\nbuilder", early); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Record(MaildirID(testMaildirName), "carol", early.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := b.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The unrecorded file has the newest modification time
+	want := []string{"files/undecrypted/b", "maildir/new/" + testMaildirName, "files/a.txt"}
+	if got := ids(entries); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("got entries %q, want %q", got, want)
+	}
+	if e := entries[2]; e.Sender != "bob the builder" || !e.Received.Equal(early) || e.Size != 5 || e.Name != "a.txt" || e.New {
+		t.Errorf("a.txt listed as %+v", e)
+	}
+	if e := entries[1]; e.Sender != "carol" || !e.New || e.Name != testMaildirName {
+		t.Errorf("Maildir message listed as %+v", e)
+	}
+	if e := entries[0]; e.Sender != "" {
+		t.Errorf("unrecorded file has sender %q", e.Sender)
+	}
+}
+
+func TestListAfterFlagRename(t *testing.T) {
+	b := testBox(t)
+	received := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	if err := b.Record(MaildirID(testMaildirName), "carol", received); err != nil {
+		t.Fatal(err)
+	}
+
+	// A mail client marks the message as seen
+	seen := testMaildirName + ":2,S"
+	if err := os.Rename(filepath.Join(b.Maildir, "new", testMaildirName), filepath.Join(b.Maildir, "cur", seen)); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := b.Find("maildir/cur/" + seen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Sender != "carol" || !e.Received.Equal(received) || e.New {
+		t.Errorf("seen message listed as %+v", e)
+	}
+	if _, err := b.Find(MaildirID(testMaildirName)); !errors.Is(err, ErrNotFound) {
+		t.Errorf("old ID still found: %v", err)
+	}
+
+	if err := b.Remove("maildir/cur/" + seen); err != nil {
+		t.Fatal(err)
+	}
+	index, err := b.readIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index) != 0 {
+		t.Errorf("index still holds %v", index)
+	}
+}
+
+func TestFindEscapes(t *testing.T) {
+	b := testBox(t)
+	for _, id := range []string{
+		"",
+		"a.txt",
+		"files/",
+		"files/../outside.txt",
+		"files/undecrypted/../../outside.txt",
+		"files//a.txt",
+		"files/./a.txt",
+		"files/.hidden",
+		"files/" + IndexFile,
+		"files/Maildir/new/" + testMaildirName,
+		"maildir/tmp/partial",
+		"maildir/new/../../../outside.txt",
+		"maildir/cur/.hidden",
+		"/etc/passwd",
+		filepath.Join(b.Dir, "a.txt"),
+	} {
+		if e, err := b.Find(id); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Find(%q) = %+v, %v, want ErrNotFound", id, e, err)
+		}
+		if err := b.Remove(id); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Remove(%q) = %v, want ErrNotFound", id, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(b.Dir, "..", "outside.txt")); err != nil {
+		t.Errorf("file outside of the Box removed: %v", err)
+	}
+
+	file, e, err := b.Open("files/undecrypted/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	content, _ := io.ReadAll(file)
+	if string(content) != "second" || e.Name != "b" {
+		t.Errorf("opened %q as %+v", content, e)
+	}
+}
+
+func TestRemoveDigest(t *testing.T) {
+	b := testBox(t)
+	received := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, id := range []string{FileID("a.txt"), MaildirID(testMaildirName), FileID("a.txt.bak")} {
+		if err := b.Record(id, "bob", received); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := b.RemoveDigest(FileID("a.txt"), digest("other")); !errors.Is(err, ErrDigestMismatch) {
+		t.Errorf("removal with the wrong digest: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(b.Dir, "a.txt")); err != nil {
+		t.Errorf("file removed despite the wrong digest: %v", err)
+	}
+	if err := b.RemoveDigest(FileID("missing"), digest("first")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("removal of a missing file: %v", err)
+	}
+
+	if err := b.RemoveDigest(FileID("a.txt"), strings.ToUpper(digest("first"))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(b.Dir, "a.txt")); !os.IsNotExist(err) {
+		t.Errorf("file not removed: %v", err)
+	}
+
+	// Only the line of the removed file is forgotten
+	index, err := b.readIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := index[FileID("a.txt")]; ok || len(index) != 2 {
+		t.Errorf("index after removal: %v", index)
+	}
+	if err := b.RemoveDigest(FileID("a.txt"), digest("first")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("second removal: %v", err)
+	}
+}
@@ -0,0 +1,220 @@
+package ocinbox
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// CheckLoopback returns an error unless addr, as given to
+// http.ListenAndServe, only listens on a loopback address.
+func CheckLoopback(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if !isLoopbackHost(host) {
+		return fmt.Errorf("%s is not a loopback address", addr)
+	}
+	return nil
+}
+
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// ui serves the web inbox.
+type ui struct {
+	boxes []*Box
+	token string // guards the delete form against other web sites
+}
+
+// Handler returns the web inbox for boxes. It lists the entries of every
+// Box and lets them be viewed, downloaded and deleted. Requests which
+// don't name a loopback host are refused, so the inbox can't be reached
+// through DNS rebinding.
+func Handler(boxes []*Box) http.Handler {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		panic(err)
+	}
+	u := &ui{boxes: boxes, token: hex.EncodeToString(token)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", u.handleList)
+	mux.HandleFunc("/view", u.handleView)
+	mux.HandleFunc("/download", u.handleView)
+	mux.HandleFunc("/delete", u.handleDelete)
+	return u.checkHost(mux)
+}
+
+func (u *ui) checkHost(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if !isLoopbackHost(strings.Trim(host, "[]")) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("X-Frame-Options", "DENY")
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (u *ui) box(name string) *Box {
+	for _, b := range u.boxes {
+		if b.Name == name {
+			return b
+		}
+	}
+	return nil
+}
+
+var listTemplate = template.Must(template.New("list").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Onion Courier inbox</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { padding: 0.3em 0.8em; text-align: left; border-bottom: 1px solid #ccc; }
+td.size { text-align: right; }
+tr.new td { font-weight: bold; }
+form { display: inline; }
+</style>
+</head>
+<body>
+<h1>Onion Courier inbox</h1>
+{{range .Boxes}}
+<h2>{{.Name}}</h2>
+{{if .Error}}<p>Error: {{.Error}}</p>
+{{else if not .Entries}}<p>No files.</p>
+{{else}}
+<table>
+<tr><th>Name</th><th>Sender</th><th>Received</th><th>Size</th><th></th></tr>
+{{range .Entries}}<tr{{if .New}} class="new"{{end}}>
+<td>{{.Name}}</td>
+<td>{{if .Sender}}{{.Sender}}{{else}}unknown{{end}}</td>
+<td>{{.Received.Format "2006-01-02 15:04:05"}}</td>
+<td class="size">{{.Size}}</td>
+<td><a href="/view?{{.Query}}">view</a>
+<a href="/download?{{.Query}}">download</a>
+<form method="post" action="/delete"><input type="hidden" name="box" value="{{.Box}}"><input type="hidden" name="id" value="{{.ID}}"><input type="hidden" name="token" value="{{$.Token}}"><input type="submit" value="delete"></form></td>
+</tr>
+{{end}}</table>
+{{end}}
+{{end}}
+</body>
+</html>
+`))
+
+type listEntry struct {
+	Entry
+	Box   string
+	Query template.URL
+}
+
+type listBox struct {
+	Name    string
+	Entries []listEntry
+	Error   error
+}
+
+func (u *ui) handleList(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	data := struct {
+		Boxes []listBox
+		Token string
+	}{Token: u.token}
+	for _, b := range u.boxes {
+		lb := listBox{Name: b.Name}
+		entries, err := b.List()
+		lb.Error = err
+		for _, e := range entries {
+			query := url.Values{"box": {b.Name}, "id": {e.ID}}.Encode()
+			lb.Entries = append(lb.Entries, listEntry{Entry: e, Box: b.Name, Query: template.URL(query)})
+		}
+		data.Boxes = append(data.Boxes, lb)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := listTemplate.Execute(w, data); err != nil {
+		fmt.Fprintf(w, "Error: %v", template.HTMLEscapeString(err.Error()))
+	}
+}
+
+// handleView shows an entry as plain text, or offers it for download.
+func (u *ui) handleView(w http.ResponseWriter, r *http.Request) {
+	b := u.box(r.URL.Query().Get("box"))
+	if b == nil {
+		http.NotFound(w, r)
+		return
+	}
+	file, e, err := b.Open(r.URL.Query().Get("id"))
+	if errors.Is(err, ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	if r.URL.Path == "/download" {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": e.Name}))
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	io.Copy(w, file)
+}
+
+func (u *ui) handleDelete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST requests are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.PostFormValue("token")), []byte(u.token)) != 1 {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	b := u.box(r.PostFormValue("box"))
+	if b == nil {
+		http.NotFound(w, r)
+		return
+	}
+	err := b.Remove(r.PostFormValue("id"))
+	if errors.Is(err, ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
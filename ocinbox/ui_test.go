@@ -0,0 +1,100 @@
+package ocinbox
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckLoopback(t *testing.T) {
+	tests := []struct {
+		addr string
+		ok   bool
+	}{
+		{"127.0.0.1:8079", true},
+		{"127.1.2.3:8079", true},
+		{"localhost:8079", true},
+		{"[::1]:8079", true},
+		{":8079", false},
+		{"0.0.0.0:8079", false},
+		{"[::]:8079", false},
+		{"192.168.1.2:8079", false},
+		{"example.com:8079", false},
+		{"127.0.0.1", false},
+	}
+	for _, test := range tests {
+		if err := CheckLoopback(test.addr); (err == nil) != test.ok {
+			t.Errorf("CheckLoopback(%q) = %v, want ok %v", test.addr, err, test.ok)
+		}
+	}
+}
+
+func TestCheckHost(t *testing.T) {
+	handler := Handler([]*Box{testBox(t)})
+	tests := []struct {
+		host   string
+		status int
+	}{
+		{"127.0.0.1:8079", http.StatusOK},
+		{"localhost:8079", http.StatusOK},
+		{"localhost", http.StatusOK},
+		{"[::1]:8079", http.StatusOK},
+		{"evil.example:8079", http.StatusForbidden},
+		{"127.0.0.1.evil.example", http.StatusForbidden},
+		{"localhost.evil.example:8079", http.StatusForbidden},
+		{"", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Host = test.host
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("Host %q: got status %d, want %d", test.host, w.Code, test.status)
+		}
+		if w.Code == http.StatusOK && w.Header().Get("Content-Security-Policy") == "" {
+			t.Errorf("Host %q: no Content-Security-Policy", test.host)
+		}
+	}
+}
+
+func TestDeleteToken(t *testing.T) {
+	b := testBox(t)
+	handler := Handler([]*Box{b})
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Host = "127.0.0.1:8079"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	_, rest, ok := strings.Cut(w.Body.String(), `name="token" value="`)
+	if !ok {
+		t.Fatal("no token in the list")
+	}
+	token, _, _ := strings.Cut(rest, `"`)
+
+	for _, test := range []struct {
+		token  string
+		status int
+	}{
+		{"", http.StatusForbidden},
+		{"0123456789abcdef0123456789abcdef", http.StatusForbidden},
+		{token, http.StatusSeeOther},
+	} {
+		form := url.Values{"box": {"alice"}, "id": {"files/a.txt"}, "token": {test.token}}
+		r := httptest.NewRequest(http.MethodPost, "/delete", strings.NewReader(form.Encode()))
+		r.Host = "127.0.0.1:8079"
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("token %q: got status %d, want %d", test.token, w.Code, test.status)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(b.Dir, "a.txt")); !os.IsNotExist(err) {
+		t.Errorf("file not deleted: %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+// Package ocmail reads the messages oc_email_server hands to an MTA. Only
+// the header block, up to the first empty line, is parsed, so lines in
+// the body never change the recipients.
+package ocmail
+
+import (
+	"bytes"
+	"fmt"
+	"net/mail"
+	"strings"
+)
+
+// recipientFields are the header fields the recipients are taken from.
+var recipientFields = []string{"To", "Cc", "Bcc"}
+
+// Headers are the fields of a message the gateway needs.
+type Headers struct {
+	Recipients []*mail.Address // To, Cc and Bcc, in that order
+	To         string          // value of the To fields
+	Newsgroups string          // value of the Newsgroups fields
+	From       string          // empty if there is no From field
+}
+
+// Parse parses the header block of message. Fields may be folded and hold
+// several addresses. A malformed header block or address list, and more
+// than one From field, are an error.
+func Parse(message []byte) (Headers, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(message))
+	if err != nil {
+		return Headers{}, fmt.Errorf("malformed message header: %v", err)
+	}
+
+	var h Headers
+	for _, name := range recipientFields {
+		for _, value := range msg.Header[name] {
+			list, err := mail.ParseAddressList(value)
+			if err != nil {
+				return Headers{}, fmt.Errorf("malformed %s header: %v", name, err)
+			}
+			h.Recipients = append(h.Recipients, list...)
+		}
+	}
+	h.To = strings.Join(msg.Header["To"], ", ")
+	h.Newsgroups = strings.Join(msg.Header["Newsgroups"], ",")
+
+	if values := msg.Header["From"]; len(values) > 1 {
+		return Headers{}, fmt.Errorf("malformed From header: more than one")
+	} else if len(values) == 1 {
+		if _, err := mail.ParseAddress(values[0]); err != nil {
+			return Headers{}, fmt.Errorf("malformed From header: %v", err)
+		}
+		h.From = values[0]
+	}
+	return h, nil
+}
@@ -0,0 +1,68 @@
+package ocmail
+
+import (
+	"strings"
+	"testing"
+)
+
+func addresses(h Headers) string {
+	var list []string
+	for _, addr := range h.Recipients {
+		list = append(list, addr.Address)
+	}
+	return strings.Join(list, " ")
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name, message, recipients, from string
+	}{
+		{
+			"body line",
+			"From: a@example.com\nTo: real@example.com\n\nTo: x@y\n",
+			"real@example.com", "a@example.com",
+		},
+		{
+			"folded To",
+			"To: one@example.com,\r\n two@example.com,\r\n\tThree <three@example.com>\r\nSubject: s\r\n\r\nbody\r\n",
+			"one@example.com two@example.com three@example.com", "",
+		},
+		{
+			"Cc and Bcc",
+			"To: to@example.com\nCc: cc1@example.com, cc2@example.com\nBcc: bcc1@example.com, <bcc2@example.com>\n\nbody\n",
+			"to@example.com cc1@example.com cc2@example.com bcc1@example.com bcc2@example.com", "",
+		},
+		{
+			"no recipients",
+			"Subject: s\n\nTo: x@y\n",
+			"", "",
+		},
+	}
+	for _, tt := range tests {
+		h, err := Parse([]byte(tt.message))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := addresses(h); got != tt.recipients {
+			t.Errorf("%s: recipients %q, want %q", tt.name, got, tt.recipients)
+		}
+		if h.From != tt.from {
+			t.Errorf("%s: From %q, want %q", tt.name, h.From, tt.from)
+		}
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	for _, message := range []string{
+		"To x@example.com\n\nbody\n",
+		"To: <<broken\n\nbody\n",
+		"Cc: a@example.com b@example.com\n\nbody\n",
+		"From: a@example.com\nFrom: b@example.com\nTo: x@example.com\n\nbody\n",
+		"From: not an address\nTo: x@example.com\n\nbody\n",
+	} {
+		if _, err := Parse([]byte(message)); err == nil {
+			t.Errorf("Parse(%q) succeeded", message)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package ocmail
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// DefaultFields are the header fields passed to the MTA by default.
+const DefaultFields = "From,To,Cc,Reply-To,Subject,In-Reply-To,Followup-To,X-No-Archive,MIME-Version,Content-Type,Content-Transfer-Encoding,Content-Disposition"
+
+// Date modes of a Policy.
+const (
+	DateRound  = "round"  // rounded down to the precision
+	DateRandom = "random" // random, within the precision before now
+)
+
+// alwaysPassed are the header fields mail2news gateways need, which are
+// passed whatever the policy says.
+var alwaysPassed = []string{"Newsgroups", "References"}
+
+// Policy decides which header fields of a message reach the MTA. Date and
+// Message-ID are always replaced by the gateway, so they can't identify
+// the sender's software or clock.
+type Policy struct {
+	passed    map[string]bool // canonical field names
+	dateMode  string
+	precision time.Duration
+	idDomain  string
+}
+
+// NewPolicy returns a Policy passing the comma separated header fields,
+// besides Newsgroups and References. Message-IDs end in idDomain. Bcc
+// can't be passed, as it would disclose the blind copies.
+func NewPolicy(fields, dateMode string, precision time.Duration, idDomain string) (*Policy, error) {
+	if dateMode != DateRound && dateMode != DateRandom {
+		return nil, fmt.Errorf("unknown date mode %q, want %s or %s", dateMode, DateRound, DateRandom)
+	}
+	if precision <= 0 {
+		return nil, fmt.Errorf("date precision must be positive")
+	}
+
+	p := &Policy{passed: make(map[string]bool), dateMode: dateMode, precision: precision, idDomain: idDomain}
+	for _, name := range strings.Split(fields, ",") {
+		name = textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name))
+		switch name {
+		case "":
+			continue
+		case "Bcc":
+			return nil, fmt.Errorf("the Bcc field can't be passed")
+		case "Date", "Message-Id":
+			// Always generated by the gateway
+			continue
+		}
+		p.passed[name] = true
+	}
+	for _, name := range alwaysPassed {
+		p.passed[name] = true
+	}
+	return p, nil
+}
+
+// Passes reports whether the header field name reaches the MTA.
+func (p *Policy) Passes(name string) bool {
+	return p.passed[textproto.CanonicalMIMEHeaderKey(name)]
+}
+
+// Apply returns message, sent at now, with only the passed header fields,
+// after a Date and Message-ID of the gateway. The body is left alone.
+func (p *Policy) Apply(message []byte, now time.Time) ([]byte, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	date, err := p.date(now)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "Date: %s\r\nMessage-ID: <%s@%s>\r\n", date.Format(time.RFC1123Z), hex.EncodeToString(id), p.idDomain)
+
+	rest := message
+	pass := false
+	for len(rest) > 0 {
+		line := rest
+		if i := bytes.IndexByte(rest, '\n'); i >= 0 {
+			line = rest[:i+1]
+		}
+		rest = rest[len(line):]
+
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			out.Write(line)
+			out.Write(rest)
+			break
+		}
+		// Continuation lines of folded fields follow their field
+		if line[0] != ' ' && line[0] != '\t' {
+			name, _, _ := bytes.Cut(line, []byte(":"))
+			pass = p.Passes(strings.TrimSpace(string(name)))
+		}
+		if pass {
+			out.Write(line)
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// date returns the Date of a message sent at now: rounded down to the
+// precision, or a random time within the precision before now.
+func (p *Policy) date(now time.Time) (time.Time, error) {
+	now = now.UTC()
+	if p.dateMode == DateRound {
+		return now.Truncate(p.precision), nil
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(p.precision)))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return now.Add(-time.Duration(n.Int64())).Truncate(time.Second), nil
+}
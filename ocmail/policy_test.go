@@ -0,0 +1,120 @@
+package ocmail
+
+import (
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testMessage = "From: a@example.com\r\n" +
+	"To: x@example.com\r\n" +
+	"Bcc: secret@example.com\r\n" +
+	"Date: Mon, 01 Jan 2024 10:11:12 +0200\r\n" +
+	"Message-ID: <abc@client.example>\r\n" +
+	"User-Agent: Mail Client 1.0\r\n" +
+	"X-Mailer: something\r\n" +
+	"  folded\r\n" +
+	"Newsgroups: alt.test\r\n" +
+	"References: <1@example.com>\r\n" +
+	" <2@example.com>\r\n" +
+	"Subject: test\r\n" +
+	"\r\n" +
+	"User-Agent: kept in the body\r\n"
+
+func TestApply(t *testing.T) {
+	p, err := NewPolicy(DefaultFields, DateRound, time.Hour, "gateway.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 3, 1, 14, 35, 10, 0, time.FixedZone("CET", 3600))
+	out, err := p.Apply([]byte(testMessage), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader(string(out)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := msg.Header
+	if got := h.Get("Newsgroups"); got != "alt.test" {
+		t.Errorf("Newsgroups %q, want alt.test", got)
+	}
+	if got := h.Get("References"); got != "<1@example.com> <2@example.com>" {
+		t.Errorf("References %q, want both message IDs", got)
+	}
+	for _, name := range []string{"From", "To", "Subject"} {
+		if h.Get(name) == "" {
+			t.Errorf("%s was removed", name)
+		}
+	}
+	for _, name := range []string{"Bcc", "User-Agent", "X-Mailer"} {
+		if got := h.Get(name); got != "" {
+			t.Errorf("%s %q was passed", name, got)
+		}
+	}
+
+	if got := h["Date"]; len(got) != 1 || got[0] != "Fri, 01 Mar 2024 13:00:00 +0000" {
+		t.Errorf("Date %q, want the rounded gateway time", got)
+	}
+	if got := h["Message-Id"]; len(got) != 1 || got[0] == "<abc@client.example>" || !strings.HasSuffix(got[0], "@gateway.example>") {
+		t.Errorf("Message-ID %q, want one of the gateway", got)
+	}
+
+	if !strings.HasSuffix(string(out), "\r\n\r\nUser-Agent: kept in the body\r\n") {
+		t.Errorf("body changed: %q", out)
+	}
+}
+
+func TestApplyRandomDate(t *testing.T) {
+	p, err := NewPolicy(DefaultFields, DateRandom, 2*time.Hour, "gateway.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 3, 1, 14, 35, 10, 0, time.UTC)
+	for i := 0; i < 20; i++ {
+		out, err := p.Apply([]byte(testMessage), now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := mail.ReadMessage(strings.NewReader(string(out)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		date, err := msg.Header.Date()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if date.After(now) || date.Before(now.Add(-2*time.Hour)) {
+			t.Errorf("Date %v not within 2h before %v", date, now)
+		}
+	}
+}
+
+func TestPolicyFrom(t *testing.T) {
+	p, err := NewPolicy("To,Subject", DateRound, time.Hour, "gateway.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Passes("From") {
+		t.Error("From passes without being listed")
+	}
+	for _, name := range []string{"newsgroups", "References", "to"} {
+		if !p.Passes(name) {
+			t.Errorf("%s does not pass", name)
+		}
+	}
+}
+
+func TestNewPolicyErrors(t *testing.T) {
+	if _, err := NewPolicy("To,Bcc", DateRound, time.Hour, "gateway.example"); err == nil {
+		t.Error("Bcc accepted")
+	}
+	if _, err := NewPolicy(DefaultFields, "keep", time.Hour, "gateway.example"); err == nil {
+		t.Error("unknown date mode accepted")
+	}
+	if _, err := NewPolicy(DefaultFields, DateRound, 0, "gateway.example"); err == nil {
+		t.Error("zero precision accepted")
+	}
+}
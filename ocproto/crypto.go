@@ -0,0 +1,144 @@
+package ocproto
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"io"
+
+	"filippo.io/edwards25519"
+	"github.com/awnumar/memguard"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// overhead is the size of the ephemeral public key and nonce in front of
+// every ciphertext.
+const overhead = curve25519.PointSize + chacha20poly1305.NonceSizeX
+
+// Ed25519PrivateKeyToCurve25519 converts a minicrypt private key to the
+// X25519 scalar used for decryption.
+func Ed25519PrivateKeyToCurve25519(pk ed25519.PrivateKey) []byte {
+	h := sha512.New()
+	h.Write(pk.Seed())
+	out := h.Sum(nil)
+	return out[:curve25519.ScalarSize]
+}
+
+// Ed25519PublicKeyToCurve25519 converts a minicrypt public key to the X25519
+// public key used for encryption.
+func Ed25519PublicKeyToCurve25519(pk ed25519.PublicKey) ([]byte, error) {
+	p, err := new(edwards25519.Point).SetBytes(pk)
+	if err != nil {
+		return nil, err
+	}
+	return p.BytesMontgomery(), nil
+}
+
+// Encrypt encrypts everything read from reader for publicKey, like
+// minicrypt does, and writes
+// base64(ephemeral public key || nonce || ciphertext) to writer.
+func Encrypt(publicKey []byte, reader io.Reader, writer io.Writer) error {
+	plaintext, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+
+	sealed, err := seal(publicKey, plaintext)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(writer, base64.StdEncoding.EncodeToString(sealed))
+	return err
+}
+
+// Decrypt is the counterpart of Encrypt.
+func Decrypt(privKey *memguard.LockedBuffer, reader io.Reader, writer io.Writer) error {
+	encoded, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(string(encoded))
+	if err != nil {
+		return err
+	}
+
+	plaintext, err := open(privKey, decoded)
+	if err != nil {
+		return err
+	}
+
+	_, err = writer.Write(plaintext)
+	return err
+}
+
+func seal(publicKey []byte, plaintext []byte) ([]byte, error) {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid public key length")
+	}
+	curve25519PubKey, err := Ed25519PublicKeyToCurve25519(ed25519.PublicKey(publicKey))
+	if err != nil {
+		return nil, err
+	}
+
+	ephemeralPrivKey := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(ephemeralPrivKey); err != nil {
+		return nil, err
+	}
+	ephemeralPubKey, err := curve25519.X25519(ephemeralPrivKey, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+
+	sharedSecret, err := curve25519.X25519(ephemeralPrivKey, curve25519PubKey)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := chacha20poly1305.NewX(sharedSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, overhead+len(plaintext)+aead.Overhead())
+	out = append(append(out, ephemeralPubKey...), nonce...)
+	return aead.Seal(out, nonce, plaintext, nil), nil
+}
+
+func open(privKey *memguard.LockedBuffer, sealed []byte) ([]byte, error) {
+	if len(sealed) < overhead {
+		return nil, errors.New("encoded input too short")
+	}
+
+	curve25519PrivKey := Ed25519PrivateKeyToCurve25519(ed25519.PrivateKey(privKey.Bytes()))
+	curve25519PrivKeyLocked := memguard.NewBufferFromBytes(curve25519PrivKey)
+	defer curve25519PrivKeyLocked.Destroy()
+
+	ephemeralPubKey := sealed[:curve25519.PointSize]
+	nonce := sealed[curve25519.PointSize:overhead]
+	ciphertext := sealed[overhead:]
+
+	sharedSecret, err := curve25519.X25519(curve25519PrivKeyLocked.Bytes(), ephemeralPubKey)
+	if err != nil {
+		return nil, err
+	}
+
+	sharedSecretLocked := memguard.NewBufferFromBytes(sharedSecret)
+	defer sharedSecretLocked.Destroy()
+
+	aead, err := chacha20poly1305.NewX(sharedSecretLocked.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
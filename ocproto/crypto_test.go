@@ -0,0 +1,132 @@
+package ocproto
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/awnumar/memguard"
+	"golang.org/x/crypto/curve25519"
+)
+
+// testChain returns n nodes with fresh keys, and their private keys.
+func testChain(t *testing.T, n int) ([]Hop, []*memguard.LockedBuffer) {
+	t.Helper()
+	var chain []Hop
+	var keys []*memguard.LockedBuffer
+	for i := 0; i < n; i++ {
+		publicKey, privateKey, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chain = append(chain, Hop{
+			Address:   fmt.Sprintf("node%d.onion:8088", i),
+			Password:  fmt.Sprintf("password%d", i),
+			PublicKey: publicKey,
+		})
+		keys = append(keys, memguard.NewBufferFromBytes(privateKey))
+	}
+	return chain, keys
+}
+
+func TestKeyConversion(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fromPublic, err := Ed25519PublicKeyToCurve25519(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromPrivate, err := curve25519.X25519(Ed25519PrivateKeyToCurve25519(privateKey), curve25519.Basepoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fromPublic, fromPrivate) {
+		t.Error("converted public key doesn't match converted private key")
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	chain, keys := testChain(t, 2)
+	plaintext := []byte("Hello world!\n")
+
+	var encrypted bytes.Buffer
+	if err := Encrypt(chain[0].PublicKey, bytes.NewReader(plaintext), &encrypted); err != nil {
+		t.Fatal(err)
+	}
+
+	var decrypted bytes.Buffer
+	if err := Decrypt(keys[0], bytes.NewReader(encrypted.Bytes()), &decrypted); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted.Bytes(), plaintext) {
+		t.Errorf("got %q, want %q", decrypted.Bytes(), plaintext)
+	}
+
+	if err := Decrypt(keys[1], bytes.NewReader(encrypted.Bytes()), &decrypted); err == nil {
+		t.Error("decryption with the wrong key succeeded")
+	}
+
+	sealed, _ := base64.StdEncoding.DecodeString(encrypted.String())
+	sealed[len(sealed)-1] ^= 1
+	tampered := base64.StdEncoding.EncodeToString(sealed)
+	if err := Decrypt(keys[0], bytes.NewReader([]byte(tampered)), &decrypted); err == nil {
+		t.Error("decryption of a tampered ciphertext succeeded")
+	}
+
+	short := base64.StdEncoding.EncodeToString(make([]byte, 10))
+	if err := Decrypt(keys[0], bytes.NewReader([]byte(short)), &decrypted); err == nil {
+		t.Error("decryption of a short input succeeded")
+	}
+}
+
+func TestLoadKeys(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	privatePath := filepath.Join(dir, "private.pem")
+	publicPath := filepath.Join(dir, "public.pem")
+	writePEM(t, privatePath, "PRIVATE KEY", privateKey)
+	writePEM(t, publicPath, "PUBLIC KEY", publicKey)
+
+	locked, err := LoadPEM(privatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer locked.Destroy()
+	if !bytes.Equal(locked.Bytes(), privateKey) {
+		t.Error("LoadPEM returned a different key")
+	}
+
+	for _, s := range []string{publicPath, base64.StdEncoding.EncodeToString(publicKey)} {
+		got, err := ParsePublicKey(s)
+		if err != nil {
+			t.Fatalf("ParsePublicKey(%q): %v", s, err)
+		}
+		if !bytes.Equal(got, publicKey) {
+			t.Errorf("ParsePublicKey(%q) returned a different key", s)
+		}
+	}
+
+	if _, err := ParsePublicKey("c2hvcnQ="); err == nil {
+		t.Error("ParsePublicKey accepted a short key")
+	}
+}
+
+func writePEM(t *testing.T, path, blockType string, data []byte) {
+	t.Helper()
+	encoded := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: data})
+	if err := os.WriteFile(path, encoded, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
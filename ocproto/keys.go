@@ -0,0 +1,64 @@
+package ocproto
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/awnumar/memguard"
+)
+
+// LoadPEM loads a private key, as created by minicrypt -g, into locked
+// memory.
+func LoadPEM(filename string) (*memguard.LockedBuffer, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("PEM decoding failed")
+	}
+	if len(block.Bytes) < ed25519.SeedSize {
+		return nil, fmt.Errorf("invalid private key length %d", len(block.Bytes))
+	}
+	return memguard.NewBufferFromBytes(block.Bytes), nil
+}
+
+// LoadPublicKey loads a public key from a PEM file, as created by
+// minicrypt -g.
+func LoadPublicKey(filename string) ([]byte, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("PEM decoding failed")
+	}
+	return checkPublicKey(block.Bytes)
+}
+
+// ParsePublicKey accepts a base64 encoded public key, as published in
+// README_public_nodes.txt, or the path to a PEM file containing one.
+func ParsePublicKey(s string) ([]byte, error) {
+	if _, err := os.Stat(s); err == nil {
+		return LoadPublicKey(s)
+	}
+
+	publicKey, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %v", err)
+	}
+	return checkPublicKey(publicKey)
+}
+
+func checkPublicKey(publicKey []byte) ([]byte, error) {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key length %d", len(publicKey))
+	}
+	return publicKey, nil
+}
@@ -0,0 +1,100 @@
+// Package ocproto implements the Onion Courier protocol: the minicrypt
+// encryption used between hops, the X-OC-To: routing header and the
+// fixed-size version 2 packet format.
+//
+// A legacy message for a node is a minicrypt encrypted text, whose first
+// header names the next hop:
+//
+//	X-OC-To: address:port password
+//
+// The node strips this header and posts the remainder to the next hop.
+package ocproto
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrNoHeaders is returned by ParseHop for messages without headers.
+	ErrNoHeaders = errors.New("no valid headers found")
+	// ErrInvalidHop is returned by ParseHop if the first header is not a
+	// valid X-OC-To: header.
+	ErrInvalidHop = errors.New("invalid header format (missing X-OC-To)")
+)
+
+// Hop is a node or final destination in a chain. The final destination
+// needs no public key, as it receives the innermost message.
+type Hop struct {
+	Nickname  string
+	Address   string
+	Password  string
+	PublicKey []byte
+}
+
+// ParseHop reads the X-OC-To: header of a decrypted message and returns
+// the next hop along with the message to send to it, which is the
+// message without that header.
+func ParseHop(message []byte) (Hop, []byte, error) {
+	lines := strings.Split(string(message), "\n")
+	var headers []string
+	var messageBody string
+
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			messageBody = strings.Join(lines[i+1:], "\n")
+			break
+		}
+		headers = append(headers, line)
+	}
+
+	if len(headers) == 0 {
+		return Hop{}, nil, ErrNoHeaders
+	}
+
+	headerParts := strings.SplitN(headers[0], " ", 3)
+	if len(headerParts) != 3 || headerParts[0] != "X-OC-To:" {
+		return Hop{}, nil, ErrInvalidHop
+	}
+
+	hop := Hop{
+		Address:  headerParts[1],
+		Password: strings.TrimSpace(headerParts[2]),
+	}
+	rest := strings.Join(append(headers[1:], "", messageBody), "\n")
+	return hop, []byte(rest), nil
+}
+
+// BuildHop prepends the X-OC-To: header for next to payload. If payload is
+// an encrypted layer for another node, layered must be true, so the
+// header is separated from it by an empty line. Otherwise payload is the
+// final message and its own headers follow the X-OC-To: header.
+func BuildHop(next Hop, payload []byte, layered bool) []byte {
+	var layer bytes.Buffer
+	fmt.Fprintf(&layer, "X-OC-To: %s %s\n", next.Address, next.Password)
+	if layered {
+		layer.WriteString("\n")
+	}
+	layer.Write(payload)
+	return layer.Bytes()
+}
+
+// BuildOnion wraps message for destination in one legacy minicrypt layer
+// per node of chain, so it can be posted to the first node.
+func BuildOnion(message []byte, chain []Hop, destination Hop) ([]byte, error) {
+	payload := message
+	next := destination
+	for i := len(chain) - 1; i >= 0; i-- {
+		layer := BuildHop(next, payload, i < len(chain)-1)
+
+		var encrypted bytes.Buffer
+		if err := Encrypt(chain[i].PublicKey, bytes.NewReader(layer), &encrypted); err != nil {
+			return nil, fmt.Errorf("layer for %s: %w", chain[i].Address, err)
+		}
+		payload = encrypted.Bytes()
+		next = chain[i]
+	}
+	return payload, nil
+}
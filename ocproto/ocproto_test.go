@@ -0,0 +1,94 @@
+package ocproto
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestParseHop(t *testing.T) {
+	message := "X-OC-To: abc.onion:8082 secret\r\nTo: bob@example.org\nSubject: Hello\n\nHi Bob!\n"
+
+	hop, rest, err := ParseHop([]byte(message))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hop.Address != "abc.onion:8082" || hop.Password != "secret" {
+		t.Errorf("got hop %+v", hop)
+	}
+	if want := "To: bob@example.org\nSubject: Hello\n\nHi Bob!\n"; string(rest) != want {
+		t.Errorf("got rest %q, want %q", rest, want)
+	}
+}
+
+func TestParseHopErrors(t *testing.T) {
+	tests := []struct {
+		message string
+		err     error
+	}{
+		{"\nbody", ErrNoHeaders},
+		{"To: bob@example.org\n\nbody", ErrInvalidHop},
+		{"X-OC-To: abc.onion:8082\n\nbody", ErrInvalidHop},
+	}
+	for _, tt := range tests {
+		if _, _, err := ParseHop([]byte(tt.message)); !errors.Is(err, tt.err) {
+			t.Errorf("ParseHop(%q) = %v, want %v", tt.message, err, tt.err)
+		}
+	}
+}
+
+func TestBuildHop(t *testing.T) {
+	next := Hop{Address: "abc.onion:8088", Password: "secret"}
+	for _, layered := range []bool{false, true} {
+		payload := []byte("To: bob@example.org\n\nHi Bob!")
+		if layered {
+			payload = []byte("SGVsbG8=")
+		}
+
+		hop, rest, err := ParseHop(BuildHop(next, payload, layered))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hop.Address != next.Address || hop.Password != next.Password {
+			t.Errorf("layered %v: got hop %+v", layered, hop)
+		}
+		if got := bytes.TrimLeft(rest, "\n"); !bytes.Equal(got, payload) {
+			t.Errorf("layered %v: got rest %q, want %q", layered, rest, payload)
+		}
+	}
+}
+
+func TestBuildOnion(t *testing.T) {
+	chain, keys := testChain(t, 3)
+	destination := Hop{Address: "mailer.onion:8082", Password: "mailer"}
+	message := []byte("To: bob@example.org\nSubject: Hello\n\nHi Bob!\n")
+
+	payload, err := BuildOnion(message, chain, destination)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, key := range keys {
+		var decrypted bytes.Buffer
+		if err := Decrypt(key, bytes.NewReader(payload), &decrypted); err != nil {
+			t.Fatalf("node %d: %v", i, err)
+		}
+		hop, rest, err := ParseHop(decrypted.Bytes())
+		if err != nil {
+			t.Fatalf("node %d: %v", i, err)
+		}
+
+		want := destination
+		if i < len(chain)-1 {
+			want = chain[i+1]
+		}
+		if hop.Address != want.Address || hop.Password != want.Password {
+			t.Fatalf("node %d: got hop %+v, want %+v", i, hop, want)
+		}
+		payload = rest
+	}
+
+	if !bytes.Equal(payload, message) {
+		t.Errorf("got %q, want %q", payload, message)
+	}
+}
@@ -0,0 +1,234 @@
+package ocproto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/awnumar/memguard"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Packet format version 2 has a constant size on every hop. The header
+// holds one encrypted routing slot per node, the body is the padded
+// message under one stream cipher layer per node.
+const (
+	PacketMagic    = "OC-Packet: 2\n"
+	HeaderSlots    = 10
+	SlotSize       = 512
+	BodySize       = 64 * 1024
+	MaxHops        = HeaderSlots
+	MaxMessageSize = BodySize - 4
+
+	routingSize  = SlotSize - overhead - chacha20poly1305.Overhead
+	routeForward = 0 // pass the packet on to the next node
+	routeDeliver = 1 // deliver the message to the final destination
+)
+
+// IsPacketV2 reports whether content is a version 2 packet.
+func IsPacketV2(content []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(content), []byte(PacketMagic))
+}
+
+// PacketDigest identifies a legacy or version 2 packet by the SHA-256 of
+// its ephemeral public key and nonce, which are unique for every
+// encryption. Nodes use it to detect replayed packets.
+func PacketDigest(content []byte) (string, error) {
+	if IsPacketV2(content) {
+		content = bytes.TrimPrefix(bytes.TrimSpace(content), []byte(PacketMagic))
+	}
+	decoded, err := base64.StdEncoding.DecodeString(string(content))
+	if err != nil {
+		return "", err
+	}
+	if len(decoded) < overhead {
+		return "", errors.New("packet too short")
+	}
+	sum := sha256.Sum256(decoded[:overhead])
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// BuildPacket builds a version 2 packet. Node i finds its routing slot
+// first in the header; it decrypts the remaining slots and the body with
+// the key from its slot and appends a random slot, so the packet keeps its
+// size. The last node unpads the body and delivers it to destination.
+func BuildPacket(message []byte, chain []Hop, destination Hop) ([]byte, error) {
+	n := len(chain)
+	if n == 0 || n > MaxHops {
+		return nil, fmt.Errorf("between 1 and %d nodes are supported", MaxHops)
+	}
+	if len(message) > MaxMessageSize {
+		return nil, fmt.Errorf("message too large, at most %d bytes are supported", MaxMessageSize)
+	}
+
+	keys := make([][]byte, n)
+	for i := range keys {
+		keys[i] = make([]byte, chacha20.KeySize)
+		if _, err := rand.Read(keys[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	body := make([]byte, BodySize)
+	binary.BigEndian.PutUint32(body, uint32(len(message)))
+	copy(body[4:], message)
+	if _, err := rand.Read(body[4+len(message):]); err != nil {
+		return nil, err
+	}
+
+	// Node i checks the body it receives against digests[i]
+	digests := make([][]byte, n)
+	for i := n - 1; i >= 0; i-- {
+		keystreamXOR(keys[i], 'b', body)
+		sum := sha256.Sum256(body)
+		digests[i] = sum[:]
+	}
+
+	rest := make([]byte, (HeaderSlots-1)*SlotSize)
+	if _, err := rand.Read(rest); err != nil {
+		return nil, err
+	}
+
+	var header []byte
+	for i := n - 1; i >= 0; i-- {
+		kind, next := byte(routeForward), destination
+		if i == n-1 {
+			kind = routeDeliver
+		} else {
+			next = chain[i+1]
+		}
+
+		routing, err := encodeRouting(kind, next, keys[i], digests[i])
+		if err != nil {
+			return nil, fmt.Errorf("slot for %s: %w", chain[i].Address, err)
+		}
+		slot, err := seal(chain[i].PublicKey, routing)
+		if err != nil {
+			return nil, fmt.Errorf("slot for %s: %w", chain[i].Address, err)
+		}
+
+		header = append(slot, rest...)
+		if i > 0 {
+			rest = make([]byte, (HeaderSlots-1)*SlotSize)
+			copy(rest, header)
+			keystreamXOR(keys[i-1], 'h', rest)
+		}
+	}
+
+	packet := append(header, body...)
+	return []byte(PacketMagic + base64.StdEncoding.EncodeToString(packet)), nil
+}
+
+// OpenPacket removes the layer for privKey from a version 2 packet. It
+// returns the re-padded packet for the next node, or the unpadded message
+// if this node is the last one, along with the hop to send it to.
+func OpenPacket(privKey *memguard.LockedBuffer, content []byte) ([]byte, Hop, error) {
+	encoded := bytes.TrimPrefix(bytes.TrimSpace(content), []byte(PacketMagic))
+	packet, err := base64.StdEncoding.DecodeString(string(encoded))
+	if err != nil {
+		return nil, Hop{}, err
+	}
+	if len(packet) != HeaderSlots*SlotSize+BodySize {
+		return nil, Hop{}, errors.New("invalid packet size")
+	}
+
+	routing, err := open(privKey, packet[:SlotSize])
+	if err != nil {
+		return nil, Hop{}, err
+	}
+	kind, next, key, digest, err := decodeRouting(routing)
+	if err != nil {
+		return nil, Hop{}, err
+	}
+
+	header := packet[SlotSize : HeaderSlots*SlotSize]
+	body := packet[HeaderSlots*SlotSize:]
+	sum := sha256.Sum256(body)
+	if subtle.ConstantTimeCompare(sum[:], digest) != 1 {
+		return nil, Hop{}, errors.New("body digest mismatch")
+	}
+
+	keystreamXOR(key, 'h', header)
+	keystreamXOR(key, 'b', body)
+
+	switch kind {
+	case routeForward:
+		padding := make([]byte, SlotSize)
+		if _, err := rand.Read(padding); err != nil {
+			return nil, Hop{}, err
+		}
+		out := make([]byte, 0, len(packet))
+		out = append(append(append(out, header...), padding...), body...)
+		return []byte(PacketMagic + base64.StdEncoding.EncodeToString(out)), next, nil
+	case routeDeliver:
+		length := binary.BigEndian.Uint32(body)
+		if length > MaxMessageSize {
+			return nil, Hop{}, errors.New("invalid message length")
+		}
+		return body[4 : 4+length], next, nil
+	default:
+		return nil, Hop{}, errors.New("unknown routing type")
+	}
+}
+
+// encodeRouting lays out a routing slot: version, kind, key, body digest,
+// then the length prefixed next address and password, zero padded.
+func encodeRouting(kind byte, next Hop, key, digest []byte) ([]byte, error) {
+	if len(next.Address) > 255 || len(next.Password) > 255 ||
+		2+len(key)+len(digest)+2+len(next.Address)+len(next.Password) > routingSize {
+		return nil, errors.New("address and password too long")
+	}
+
+	routing := make([]byte, 0, routingSize)
+	routing = append(routing, 2, kind)
+	routing = append(routing, key...)
+	routing = append(routing, digest...)
+	routing = append(routing, byte(len(next.Address)))
+	routing = append(routing, next.Address...)
+	routing = append(routing, byte(len(next.Password)))
+	routing = append(routing, next.Password...)
+	return routing[:routingSize], nil
+}
+
+func decodeRouting(routing []byte) (kind byte, next Hop, key, digest []byte, err error) {
+	if len(routing) != routingSize || routing[0] != 2 {
+		return 0, Hop{}, nil, nil, errors.New("unsupported routing slot")
+	}
+
+	kind = routing[1]
+	key = routing[2:34]
+	digest = routing[34:66]
+
+	addressLen := int(routing[66])
+	if 67+addressLen >= routingSize {
+		return 0, Hop{}, nil, nil, errors.New("invalid routing slot")
+	}
+	next.Address = string(routing[67 : 67+addressLen])
+
+	passwordLen := int(routing[67+addressLen])
+	if 68+addressLen+passwordLen > routingSize {
+		return 0, Hop{}, nil, nil, errors.New("invalid routing slot")
+	}
+	next.Password = string(routing[68+addressLen : 68+addressLen+passwordLen])
+
+	return kind, next, key, digest, nil
+}
+
+// keystreamXOR applies the ChaCha20 stream for key to data in place. The
+// domain byte keeps the header and body streams apart.
+func keystreamXOR(key []byte, domain byte, data []byte) {
+	nonce := make([]byte, chacha20.NonceSize)
+	nonce[0] = domain
+	c, err := chacha20.NewUnauthenticatedCipher(key, nonce)
+	if err != nil {
+		panic(err)
+	}
+	c.XORKeyStream(data, data)
+}
@@ -0,0 +1,116 @@
+package ocproto
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+)
+
+func TestPacketRoundTrip(t *testing.T) {
+	destination := Hop{Address: "mailer.onion:8082", Password: "mailer"}
+	message := []byte("To: bob@example.org\nSubject: Hello\n\nHi Bob!\n")
+
+	for n := 1; n <= MaxHops; n++ {
+		chain, keys := testChain(t, n)
+		packet, err := BuildPacket(message, chain, destination)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := len(packet)
+
+		for i, key := range keys {
+			if !IsPacketV2(packet) {
+				t.Fatalf("%d hops, node %d: not a version 2 packet", n, i)
+			}
+			out, hop, err := OpenPacket(key, packet)
+			if err != nil {
+				t.Fatalf("%d hops, node %d: %v", n, i, err)
+			}
+
+			want := destination
+			if i < n-1 {
+				want = chain[i+1]
+				if len(out) != size {
+					t.Fatalf("%d hops, node %d: packet size changed from %d to %d", n, i, size, len(out))
+				}
+			}
+			if hop.Address != want.Address || hop.Password != want.Password {
+				t.Fatalf("%d hops, node %d: got hop %+v, want %+v", n, i, hop, want)
+			}
+			packet = out
+		}
+
+		if !bytes.Equal(packet, message) {
+			t.Errorf("%d hops: got %q, want %q", n, packet, message)
+		}
+	}
+}
+
+func TestPacketTampered(t *testing.T) {
+	chain, keys := testChain(t, 2)
+	packet, err := BuildPacket([]byte("Hi Bob!"), chain, Hop{Address: "a.onion:80", Password: "p"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(string(packet[len(PacketMagic):]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw[len(raw)-1] ^= 1
+	tampered := []byte(PacketMagic + base64.StdEncoding.EncodeToString(raw))
+
+	if _, _, err := OpenPacket(keys[0], tampered); err == nil {
+		t.Error("tampered body was accepted")
+	}
+	if _, _, err := OpenPacket(keys[1], packet); err == nil {
+		t.Error("packet was opened with the wrong key")
+	}
+}
+
+func TestPacketLimits(t *testing.T) {
+	chain, _ := testChain(t, MaxHops+1)
+	destination := Hop{Address: "a.onion:80", Password: "p"}
+
+	if _, err := BuildPacket([]byte("Hi"), chain, destination); err == nil {
+		t.Error("too many hops were accepted")
+	}
+	if _, err := BuildPacket(make([]byte, MaxMessageSize+1), chain[:1], destination); err == nil {
+		t.Error("too large message was accepted")
+	}
+	if _, err := BuildPacket(make([]byte, MaxMessageSize), chain[:1], destination); err != nil {
+		t.Errorf("message of maximum size was rejected: %v", err)
+	}
+}
+
+func TestPacketDigest(t *testing.T) {
+	chain, _ := testChain(t, 1)
+	destination := Hop{Address: "a.onion:80", Password: "p"}
+
+	first, _ := BuildPacket([]byte("Hi"), chain, destination)
+	second, _ := BuildPacket([]byte("Hi"), chain, destination)
+
+	d1, err := PacketDigest(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d2, err := PacketDigest(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := PacketDigest(first)
+	if d1 != again {
+		t.Error("digest of the same packet changed")
+	}
+	if d1 == d2 {
+		t.Error("different packets have the same digest")
+	}
+
+	onion, err := BuildOnion([]byte("Hi"), chain, destination)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := PacketDigest(onion); err != nil {
+		t.Errorf("digest of a legacy packet: %v", err)
+	}
+}
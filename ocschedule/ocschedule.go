@@ -0,0 +1,174 @@
+// Package ocschedule implements weekly opening hours, like the
+// "Mon-Fri 15:00-21:00 UTC; Sat-Sun 11:00-21:00 UTC" of a home server.
+package ocschedule
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var dayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// window is open on days from start to end, in minutes after midnight.
+// A window with end <= start closes on the following day.
+type window struct {
+	days       [7]bool
+	start, end int
+	loc        *time.Location
+}
+
+// Schedule is a set of weekly windows. The server is open while any
+// window is open.
+type Schedule struct {
+	windows []window
+}
+
+// Parse parses a schedule: windows separated by ";", each with days, a
+// time range and an optional time zone, UTC by default. Days are names
+// like Mon, ranges like Mon-Fri or lists like Mon,Wed,Fri. A range like
+// 22:00-02:00 ends on the next day.
+func Parse(s string) (*Schedule, error) {
+	var schedule Schedule
+	for _, spec := range strings.Split(s, ";") {
+		fields := strings.Fields(spec)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) > 3 {
+			return nil, fmt.Errorf("invalid window %q", strings.TrimSpace(spec))
+		}
+
+		var w window
+		var err error
+		w.days, err = parseDays(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("window %q has no hours", strings.TrimSpace(spec))
+		}
+		from, to, ok := strings.Cut(fields[1], "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid hours %q", fields[1])
+		}
+		if w.start, err = parseClock(from); err != nil {
+			return nil, err
+		}
+		if w.end, err = parseClock(to); err != nil {
+			return nil, err
+		}
+		if w.start == 24*60 {
+			return nil, fmt.Errorf("invalid hours %q", fields[1])
+		}
+
+		w.loc = time.UTC
+		if len(fields) == 3 {
+			w.loc, err = time.LoadLocation(fields[2])
+			if err != nil {
+				return nil, fmt.Errorf("invalid time zone %q: %v", fields[2], err)
+			}
+		}
+		schedule.windows = append(schedule.windows, w)
+	}
+
+	if len(schedule.windows) == 0 {
+		return nil, errors.New("empty schedule")
+	}
+	return &schedule, nil
+}
+
+func parseDays(s string) ([7]bool, error) {
+	var days [7]bool
+	for _, part := range strings.Split(s, ",") {
+		from, to, isRange := strings.Cut(part, "-")
+		first, err := parseDay(from)
+		if err != nil {
+			return days, err
+		}
+		last := first
+		if isRange {
+			if last, err = parseDay(to); err != nil {
+				return days, err
+			}
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+func parseDay(s string) (int, error) {
+	name := strings.ToLower(s)
+	if len(name) >= 3 {
+		for i, day := range dayNames {
+			if strings.HasPrefix(name, day) {
+				return i, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("invalid day %q", s)
+}
+
+// parseClock parses HH:MM into minutes after midnight. 24:00 is allowed
+// as the end of a day.
+func parseClock(s string) (int, error) {
+	h, m, ok := strings.Cut(s, ":")
+	hours, err1 := strconv.Atoi(h)
+	minutes, err2 := strconv.Atoi(m)
+	if !ok || err1 != nil || err2 != nil || hours < 0 || minutes < 0 || minutes > 59 ||
+		hours > 24 || (hours == 24 && minutes != 0) {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return hours*60 + minutes, nil
+}
+
+func (w window) open(t time.Time) bool {
+	t = t.In(w.loc)
+	day := int(t.Weekday())
+	minute := t.Hour()*60 + t.Minute()
+	if w.start < w.end {
+		return w.days[day] && minute >= w.start && minute < w.end
+	}
+	// The window runs past midnight
+	return (w.days[day] && minute >= w.start) || (w.days[(day+6)%7] && minute < w.end)
+}
+
+// Open reports whether the schedule is open at t.
+func (s *Schedule) Open(t time.Time) bool {
+	for _, w := range s.windows {
+		if w.open(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Next returns the next time the schedule opens, or t if it is open.
+func (s *Schedule) Next(t time.Time) time.Time {
+	if s.Open(t) {
+		return t
+	}
+
+	var next time.Time
+	for _, w := range s.windows {
+		local := t.In(w.loc)
+		for offset := 0; offset <= 7; offset++ {
+			start := time.Date(local.Year(), local.Month(), local.Day()+offset, w.start/60, w.start%60, 0, 0, w.loc)
+			if !w.days[start.Weekday()] || !start.After(t) {
+				continue
+			}
+			if next.IsZero() || start.Before(next) {
+				next = start
+			}
+			break
+		}
+	}
+	return next
+}
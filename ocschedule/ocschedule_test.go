@@ -0,0 +1,85 @@
+package ocschedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	for _, s := range []string{
+		"Mon-Fri 15:00-21:00 UTC; Sat-Sun 11:00-21:00 UTC",
+		"mon,wed,fri 08:00-24:00",
+		"Fri-Mon 22:00-02:00 Europe/Berlin;",
+	} {
+		if _, err := Parse(s); err != nil {
+			t.Errorf("Parse(%q): %v", s, err)
+		}
+	}
+
+	for _, s := range []string{
+		"",
+		"Mon",
+		"Mo 10:00-12:00",
+		"Mon 10:00",
+		"Mon 25:00-26:00",
+		"Mon 24:00-01:00",
+		"Mon 10:00-12:00 Nowhere/Nothing",
+		"Mon 10:00-12:00 UTC extra",
+	} {
+		if _, err := Parse(s); err == nil {
+			t.Errorf("Parse(%q) accepted an invalid schedule", s)
+		}
+	}
+}
+
+func TestOpenAndNext(t *testing.T) {
+	s, err := Parse("Mon-Fri 15:00-21:00 UTC; Sat-Sun 11:00-21:00 UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 2024-01-01 is a Monday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, 1, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		t    time.Time
+		open bool
+		next time.Time
+	}{
+		{at(1, 14, 59), false, at(1, 15, 0)},
+		{at(1, 15, 0), true, at(1, 15, 0)},
+		{at(1, 20, 59), true, at(1, 20, 59)},
+		{at(1, 21, 0), false, at(2, 15, 0)},
+		{at(5, 22, 0), false, at(6, 11, 0)},
+		{at(7, 21, 30), false, at(8, 15, 0)},
+	}
+	for _, test := range tests {
+		if got := s.Open(test.t); got != test.open {
+			t.Errorf("Open(%v) = %v, want %v", test.t, got, test.open)
+		}
+		if got := s.Next(test.t); !got.Equal(test.next) {
+			t.Errorf("Next(%v) = %v, want %v", test.t, got, test.next)
+		}
+	}
+}
+
+func TestOvernight(t *testing.T) {
+	s, err := Parse("Fri 22:00-02:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 2024-01-05 is a Friday
+	if !s.Open(time.Date(2024, 1, 6, 1, 0, 0, 0, time.UTC)) {
+		t.Error("window is not open after midnight")
+	}
+	if s.Open(time.Date(2024, 1, 5, 1, 0, 0, 0, time.UTC)) {
+		t.Error("window is open before it started")
+	}
+	want := time.Date(2024, 1, 12, 22, 0, 0, 0, time.UTC)
+	if got := s.Next(time.Date(2024, 1, 6, 3, 0, 0, 0, time.UTC)); !got.Equal(want) {
+		t.Errorf("Next = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,171 @@
+package ocstore
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/706f6c6c7578/oc/ocauth"
+	"github.com/awnumar/memguard"
+)
+
+// Account is a user of oc_server with an own password and storage
+// directory. Accounts are found by password, as messages relayed by nodes
+// carry no username.
+type Account struct {
+	Name     string
+	Key      []byte // StoredKey of the password
+	Dir      string
+	Quota    int64 // bytes, 0 means unlimited
+	Disabled bool
+	KeyPath  string
+	PrivKey  *memguard.LockedBuffer // decrypts received messages, if set
+	Maildir  string                 // receives relayed messages, if set
+	FetchKey []byte                 // StoredKey of the mailbox password, if any
+}
+
+// ReadAccounts reads the accounts file. Every line holds an account:
+// name password_hash directory [quota=<size>] [key=<file>] [maildir=<dir>]
+// [fetch=<password_hash>] [disabled]
+// Lines starting with # are comments. All password hashes must share
+// their Params, which are returned along with the accounts.
+func ReadAccounts(filename string) ([]*Account, ocauth.Params, error) {
+	var params ocauth.Params
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, params, err
+	}
+	defer file.Close()
+
+	var result []*Account
+	names := make(map[string]bool)
+	hashes := make(map[string]bool)
+	parseHash := func(lineNumber int, hash string) ([]byte, error) {
+		p, key, err := ocauth.ParseHash(hash)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v, create it with -a %s -hash", lineNumber, err, filename)
+		}
+		if params.Salt == nil {
+			params = p
+		} else if !p.Equal(params) {
+			return nil, fmt.Errorf("line %d: password hash with another salt, create it with -a %s -hash", lineNumber, filename)
+		}
+		if hashes[string(key)] {
+			return nil, fmt.Errorf("line %d: password is used by another account", lineNumber)
+		}
+		hashes[string(key)] = true
+		return key, nil
+	}
+
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.Fields(line)
+		if len(parts) < 3 {
+			return nil, params, fmt.Errorf("line %d: expected name password_hash directory", lineNumber)
+		}
+
+		acc := &Account{Name: parts[0], Dir: parts[2]}
+		if names[acc.Name] {
+			return nil, params, fmt.Errorf("line %d: duplicate account %s", lineNumber, acc.Name)
+		}
+		acc.Key, err = parseHash(lineNumber, parts[1])
+		if err != nil {
+			return nil, params, err
+		}
+		names[acc.Name] = true
+
+		for _, option := range parts[3:] {
+			key, value, _ := strings.Cut(option, "=")
+			switch key {
+			case "quota":
+				acc.Quota, err = ParseSize(value)
+				if err != nil {
+					return nil, params, fmt.Errorf("line %d: %v", lineNumber, err)
+				}
+			case "key":
+				if value == "" {
+					return nil, params, fmt.Errorf("line %d: key needs a file name", lineNumber)
+				}
+				acc.KeyPath = value
+			case "maildir":
+				if value == "" {
+					return nil, params, fmt.Errorf("line %d: maildir needs a directory", lineNumber)
+				}
+				acc.Maildir = value
+			case "fetch":
+				acc.FetchKey, err = parseHash(lineNumber, value)
+				if err != nil {
+					return nil, params, err
+				}
+			case "disabled":
+				acc.Disabled = true
+			case "enabled":
+				acc.Disabled = false
+			default:
+				return nil, params, fmt.Errorf("line %d: unknown option %s", lineNumber, option)
+			}
+		}
+
+		if err := os.MkdirAll(acc.Dir, 0700); err != nil {
+			return nil, params, fmt.Errorf("line %d: %v", lineNumber, err)
+		}
+		result = append(result, acc)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, params, err
+	}
+
+	if len(result) == 0 {
+		return nil, params, fmt.Errorf("no accounts found")
+	}
+	return result, params, nil
+}
+
+// AccountsParams returns the Params of the password hashes in the
+// accounts file, or new ones if it doesn't exist or has no accounts yet.
+func AccountsParams(filename string) (ocauth.Params, error) {
+	file, err := os.Open(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ocauth.NewParams(), nil
+	}
+	if err != nil {
+		return ocauth.Params{}, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		parts := strings.Fields(scanner.Text())
+		if len(parts) < 3 || strings.HasPrefix(parts[0], "#") {
+			continue
+		}
+		p, _, err := ocauth.ParseHash(parts[1])
+		if err != nil {
+			return ocauth.Params{}, fmt.Errorf("%s: %v", parts[0], err)
+		}
+		return p, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return ocauth.Params{}, err
+	}
+	return ocauth.NewParams(), nil
+}
+
+// Dirs returns the directories which hold the files of acc.
+func (acc *Account) Dirs() []string {
+	if acc.Maildir == "" {
+		return []string{acc.Dir}
+	}
+	return []string{acc.Dir, acc.Maildir}
+}
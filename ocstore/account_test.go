@@ -0,0 +1,138 @@
+package ocstore
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/706f6c6c7578/oc/ocauth"
+)
+
+// testParams keep the key derivation of the tests cheap.
+var testParams = ocauth.Params{Salt: []byte("0123456789abcdef"), Time: 1, Memory: 64}
+
+// writeAccounts writes lines as an accounts file and returns its name.
+func writeAccounts(t *testing.T, lines ...string) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "accounts.txt")
+	if err := os.WriteFile(filename, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestReadAccounts(t *testing.T) {
+	root := t.TempDir()
+	aliceDir := filepath.Join(root, "alice", "files")
+	bobDir := filepath.Join(root, "bob")
+	filename := writeAccounts(t,
+		"# name hash directory",
+		"",
+		fmt.Sprintf("alice %s %s quota=1K key=alice.pem maildir=%s fetch=%s",
+			testParams.Hash("pw1"), aliceDir, filepath.Join(root, "Maildir"), testParams.Hash("fetch1")),
+		fmt.Sprintf("  bob %s %s disabled  ", testParams.Hash("pw2"), bobDir),
+	)
+
+	accounts, params, err := ReadAccounts(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !params.Equal(testParams) {
+		t.Errorf("got params %v, want %v", params, testParams)
+	}
+	if len(accounts) != 2 {
+		t.Fatalf("got %d accounts, want 2", len(accounts))
+	}
+
+	alice, bob := accounts[0], accounts[1]
+	if alice.Name != "alice" || alice.Dir != aliceDir || alice.Quota != 1024 || alice.KeyPath != "alice.pem" ||
+		alice.Maildir != filepath.Join(root, "Maildir") || alice.Disabled {
+		t.Errorf("alice read as %+v", alice)
+	}
+	if !bytes.Equal(alice.Key, testParams.StoredKey("pw1")) || !bytes.Equal(alice.FetchKey, testParams.StoredKey("fetch1")) {
+		t.Error("alice has the wrong keys")
+	}
+	if bob.Name != "bob" || !bob.Disabled || bob.FetchKey != nil || bob.Maildir != "" {
+		t.Errorf("bob read as %+v", bob)
+	}
+	if got := bob.Dirs(); len(got) != 1 || got[0] != bobDir {
+		t.Errorf("bob has dirs %q", got)
+	}
+	if got := alice.Dirs(); len(got) != 2 || got[1] != alice.Maildir {
+		t.Errorf("alice has dirs %q", got)
+	}
+
+	for _, dir := range []string{aliceDir, bobDir} {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			t.Errorf("directory %s not created: %v", dir, err)
+		}
+	}
+}
+
+func TestReadAccountsErrors(t *testing.T) {
+	dir := t.TempDir()
+	other := ocauth.Params{Salt: []byte("fedcba9876543210"), Time: 1, Memory: 64}
+	tests := []struct {
+		name  string
+		lines []string
+		err   string
+	}{
+		{"empty", []string{"# nothing"}, "no accounts found"},
+		{"short line", []string{"alice " + testParams.Hash("pw1")}, "line 1: expected name password_hash directory"},
+		{"bad hash", []string{"alice 5e884898da28 " + dir}, "line 1: invalid"},
+		{"duplicate name", []string{
+			"alice " + testParams.Hash("pw1") + " " + dir,
+			"alice " + testParams.Hash("pw2") + " " + dir,
+		}, "line 2: duplicate account alice"},
+		{"shared password", []string{
+			"alice " + testParams.Hash("pw1") + " " + dir,
+			"bob " + testParams.Hash("pw1") + " " + dir,
+		}, "line 2: password is used by another account"},
+		{"fetch password is upload password", []string{
+			"alice " + testParams.Hash("pw1") + " " + dir + " fetch=" + testParams.Hash("pw1"),
+		}, "line 1: password is used by another account"},
+		{"another salt", []string{
+			"alice " + testParams.Hash("pw1") + " " + dir,
+			"bob " + other.Hash("pw2") + " " + dir,
+		}, "line 2: password hash with another salt"},
+		{"bad quota", []string{"alice " + testParams.Hash("pw1") + " " + dir + " quota=lots"}, `line 1: invalid size "lots"`},
+		{"empty key", []string{"alice " + testParams.Hash("pw1") + " " + dir + " key="}, "line 1: key needs a file name"},
+		{"empty maildir", []string{"alice " + testParams.Hash("pw1") + " " + dir + " maildir="}, "line 1: maildir needs a directory"},
+		{"unknown option", []string{"alice " + testParams.Hash("pw1") + " " + dir + " color=red"}, "line 1: unknown option color=red"},
+	}
+	for _, test := range tests {
+		_, _, err := ReadAccounts(writeAccounts(t, test.lines...))
+		if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+			t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+		}
+	}
+
+	if _, _, err := ReadAccounts(filepath.Join(dir, "missing")); err == nil {
+		t.Error("reading a missing accounts file succeeded")
+	}
+}
+
+func TestAccountsParams(t *testing.T) {
+	p, err := AccountsParams(filepath.Join(t.TempDir(), "missing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Salt) == 0 {
+		t.Error("no new salt for a missing accounts file")
+	}
+
+	filename := writeAccounts(t, "# alice "+testParams.Hash("pw0")+" dir", "alice "+testParams.Hash("pw1")+" dir")
+	if p, err = AccountsParams(filename); err != nil {
+		t.Fatal(err)
+	}
+	if !p.Equal(testParams) {
+		t.Errorf("got params %v, want %v", p, testParams)
+	}
+
+	if _, err = AccountsParams(writeAccounts(t, "alice nohash dir")); err == nil {
+		t.Error("AccountsParams of an invalid hash succeeded")
+	}
+}
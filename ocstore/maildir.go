@@ -0,0 +1,206 @@
+package ocstore
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/706f6c6c7578/oc/ocproto"
+)
+
+// undecryptedDir is the subdirectory of an account which keeps messages
+// that could not be decrypted.
+const undecryptedDir = "undecrypted"
+
+// StoredPath returns the path of a file stored as stored, a name
+// returned by StoreMessage or one relative to the directory of acc.
+func (acc *Account) StoredPath(stored string) string {
+	if name, ok := strings.CutPrefix(stored, "maildir:"); ok {
+		return filepath.Join(acc.Maildir, "new", name)
+	}
+	return filepath.Join(acc.Dir, stored)
+}
+
+// StoreMessage decrypts the message stored as name in the directory of
+// acc, if acc has a key. A message which cannot be decrypted is moved to
+// the undecrypted subdirectory. If acc has a Maildir, the message is
+// delivered there, otherwise a decrypted message replaces the stored one
+// as name.txt. It returns where the message was stored, relative to the
+// directory of acc or prefixed with "maildir:".
+func (acc *Account) StoreMessage(name, username string, received time.Time) (string, error) {
+	path := filepath.Join(acc.Dir, name)
+	message, err := os.ReadFile(path)
+	if err != nil {
+		return name, err
+	}
+
+	if acc.PrivKey != nil {
+		var plaintext bytes.Buffer
+		if err := ocproto.Decrypt(acc.PrivKey, bytes.NewReader(bytes.TrimSpace(message)), &plaintext); err != nil {
+			kept, moveErr := acc.keepUndecrypted(name)
+			if moveErr != nil {
+				return name, moveErr
+			}
+			return kept, fmt.Errorf("not decrypted: %v", err)
+		}
+		message = plaintext.Bytes()
+	}
+
+	if acc.Maildir != "" {
+		delivered, err := deliverMaildir(acc.Maildir, maildirMessage(message, name, username, received))
+		if err != nil {
+			return name, err
+		}
+		return "maildir:" + delivered, os.Remove(path)
+	}
+
+	dst, stored, err := CreateUniqueFile(acc.Dir, name+".txt")
+	if err != nil {
+		return name, err
+	}
+	_, err = dst.Write(formatMessage(message))
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(filepath.Join(acc.Dir, stored))
+		return name, err
+	}
+	return stored, os.Remove(path)
+}
+
+// keepUndecrypted moves the message stored as name into the undecrypted
+// subdirectory of acc.
+func (acc *Account) keepUndecrypted(name string) (string, error) {
+	dir := filepath.Join(acc.Dir, undecryptedDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return name, err
+	}
+
+	// Reserve a free name, the rename replaces the empty file
+	dst, kept, err := CreateUniqueFile(dir, name)
+	if err != nil {
+		return name, err
+	}
+	dst.Close()
+	if err := os.Rename(filepath.Join(acc.Dir, name), filepath.Join(dir, kept)); err != nil {
+		os.Remove(filepath.Join(dir, kept))
+		return name, err
+	}
+	return filepath.Join(undecryptedDir, kept), nil
+}
+
+// formatMessage returns a decrypted message with its headers parsed: one
+// header per line, sorted by name, with encoded words decoded. Messages
+// without a valid header section are returned unchanged.
+func formatMessage(plaintext []byte) []byte {
+	msg, err := mail.ReadMessage(bytes.NewReader(plaintext))
+	if err != nil || len(msg.Header) == 0 {
+		return plaintext
+	}
+	body, err := io.ReadAll(msg.Body)
+	if err != nil {
+		return plaintext
+	}
+
+	keys := make([]string, 0, len(msg.Header))
+	for key := range msg.Header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var decoder mime.WordDecoder
+	var b bytes.Buffer
+	for _, key := range keys {
+		for _, value := range msg.Header[key] {
+			if decoded, err := decoder.DecodeHeader(value); err == nil {
+				value = decoded
+			}
+			fmt.Fprintf(&b, "%s: %s\n", key, value)
+		}
+	}
+	b.WriteString("\n")
+	b.Write(body)
+	return b.Bytes()
+}
+
+// maildirMessage prepends the X-OC-Received and X-OC-Username headers to
+// message. A message without a header section, like one which is still
+// encrypted, also gets a Date and a Subject, so mail clients can list it.
+func maildirMessage(message []byte, name, username string, received time.Time) []byte {
+	clean := strings.NewReplacer("\r", "", "\n", "")
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "X-OC-Received: %s\n", received.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "X-OC-Username: %s\n", clean.Replace(username))
+
+	if msg, err := mail.ReadMessage(bytes.NewReader(message)); err != nil || len(msg.Header) == 0 {
+		fmt.Fprintf(&b, "Date: %s\n", received.Format(time.RFC1123Z))
+		fmt.Fprintf(&b, "Subject: Onion Courier message %s\n", name)
+		b.WriteString("\n")
+	}
+	b.Write(message)
+	return b.Bytes()
+}
+
+// maildirCounter makes Maildir file names unique within this process.
+var maildirCounter uint64
+
+// InitMaildir creates the tmp, new and cur directories of a Maildir.
+func InitMaildir(dir string) error {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deliverMaildir writes message to the tmp directory of a Maildir and
+// moves it to new once it is complete, so readers never see a partial
+// message. It returns the name of the delivered file.
+func deliverMaildir(dir string, message []byte) (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	hostname = strings.NewReplacer("/", "\\057", ":", "\\072").Replace(hostname)
+
+	randomBytes := make([]byte, 8)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	count := atomic.AddUint64(&maildirCounter, 1)
+	name := fmt.Sprintf("%d.M%dP%dQ%dR%s.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), count, hex.EncodeToString(randomBytes), hostname)
+
+	tmpPath := filepath.Join(dir, "tmp", name)
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	_, err = file.Write(message)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, filepath.Join(dir, "new", name))
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	return name, nil
+}
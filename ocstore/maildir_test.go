@@ -0,0 +1,232 @@
+package ocstore
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/706f6c6c7578/oc/ocproto"
+	"github.com/awnumar/memguard"
+)
+
+var testReceived = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+// readDir returns the names in dir.
+func readDir(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+// upload stores content as name in the directory of acc, like oc_server
+// does before StoreMessage.
+func upload(t *testing.T, acc *Account, name string, content []byte) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(acc.Dir, name), content, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testKey returns a private key and a message encrypted to it.
+func testKey(t *testing.T, plaintext string) (*memguard.LockedBuffer, []byte) {
+	t.Helper()
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var encrypted bytes.Buffer
+	if err := ocproto.Encrypt(publicKey, strings.NewReader(plaintext), &encrypted); err != nil {
+		t.Fatal(err)
+	}
+	return memguard.NewBufferFromBytes(privateKey), encrypted.Bytes()
+}
+
+func TestDeliverMaildir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "Maildir")
+	if err := InitMaildir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := deliverMaildir(dir, []byte("one"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := deliverMaildir(dir, []byte("two"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second || strings.ContainsAny(first, "/:") {
+		t.Errorf("bad Maildir names %q and %q", first, second)
+	}
+
+	// Complete messages are only found in new
+	if names := readDir(t, filepath.Join(dir, "tmp")); len(names) != 0 {
+		t.Errorf("tmp still holds %q", names)
+	}
+	if content, err := os.ReadFile(filepath.Join(dir, "new", first)); err != nil || string(content) != "one" {
+		t.Errorf("new/%s holds %q, %v", first, content, err)
+	}
+
+	// A failed delivery leaves nothing behind
+	if err := os.RemoveAll(filepath.Join(dir, "new")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := deliverMaildir(dir, []byte("three")); err == nil {
+		t.Error("delivery without a new directory succeeded")
+	}
+	if names := readDir(t, filepath.Join(dir, "tmp")); len(names) != 0 {
+		t.Errorf("tmp still holds %q after a failed delivery", names)
+	}
+}
+
+func TestMaildirMessage(t *testing.T) {
+	tests := []struct {
+		name     string
+		message  string
+		username string
+		want     string
+	}{
+		{"with headers", "Subject: Hi\n\nHello\n", "alice",
+			"X-OC-Received: Wed, 01 May 2024 12:00:00 +0000\nX-OC-Username: alice\nSubject: Hi\n\nHello\n"},
+		{"without headers", "c2VhbGVk\n", "alice",
+			"X-OC-Received: Wed, 01 May 2024 12:00:00 +0000\nX-OC-Username: alice\n" +
+				"Date: Wed, 01 May 2024 12:00:00 +0000\nSubject: Onion Courier message m1234567\n\nc2VhbGVk\n"},
+		{"header injection", "Subject: Hi\n\nHello\n", "eve\r\nBcc: victim@example.com",
+			"X-OC-Received: Wed, 01 May 2024 12:00:00 +0000\nX-OC-Username: eveBcc: victim@example.com\nSubject: Hi\n\nHello\n"},
+	}
+	for _, test := range tests {
+		got := string(maildirMessage([]byte(test.message), "m1234567", test.username, testReceived))
+		if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestFormatMessage(t *testing.T) {
+	tests := []struct {
+		message string
+		want    string
+	}{
+		{"To: bob\r\nSubject: =?UTF-8?Q?Gr=C3=BC=C3=9Fe?=\r\nFrom: alice\r\n\r\nBody\r\n",
+			"From: alice\nSubject: Grüße\nTo: bob\n\nBody\r\n"},
+		{"no headers at all\n", "no headers at all\n"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if got := string(formatMessage([]byte(test.message))); got != test.want {
+			t.Errorf("formatMessage(%q) = %q, want %q", test.message, got, test.want)
+		}
+	}
+}
+
+func TestStoreMessageMaildir(t *testing.T) {
+	root := t.TempDir()
+	acc := &Account{Name: "alice", Dir: filepath.Join(root, "files"), Maildir: filepath.Join(root, "Maildir")}
+	if err := os.Mkdir(acc.Dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := InitMaildir(acc.Maildir); err != nil {
+		t.Fatal(err)
+	}
+	upload(t, acc, "m1234567", []byte("c2VhbGVk\n"))
+
+	stored, err := acc.StoreMessage("m1234567", "bob", testReceived)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, ok := strings.CutPrefix(stored, "maildir:")
+	if !ok {
+		t.Fatalf("stored as %q, want a Maildir name", stored)
+	}
+	if path := acc.StoredPath(stored); path != filepath.Join(acc.Maildir, "new", name) {
+		t.Errorf("StoredPath(%q) = %q", stored, path)
+	}
+	content, err := os.ReadFile(acc.StoredPath(stored))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(content, []byte("\n\nc2VhbGVk\n")) || !bytes.Contains(content, []byte("X-OC-Username: bob\n")) {
+		t.Errorf("delivered %q", content)
+	}
+	if names := readDir(t, acc.Dir); len(names) != 0 {
+		t.Errorf("upload directory still holds %q", names)
+	}
+}
+
+func TestStoreMessageDecrypted(t *testing.T) {
+	key, encrypted := testKey(t, "Subject: Hi\n\nHello\n")
+	defer key.Destroy()
+	acc := &Account{Name: "alice", Dir: t.TempDir(), PrivKey: key}
+	upload(t, acc, "m1234567", append(encrypted, '\n'))
+	upload(t, acc, "m1234567.txt", []byte("taken"))
+
+	stored, err := acc.StoreMessage("m1234567", "bob", testReceived)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored != "m1234567-1.txt" {
+		t.Errorf("stored as %q, want m1234567-1.txt", stored)
+	}
+	if content, _ := os.ReadFile(acc.StoredPath(stored)); string(content) != "Subject: Hi\n\nHello\n" {
+		t.Errorf("stored %q", content)
+	}
+	if _, err := os.Stat(filepath.Join(acc.Dir, "m1234567")); !os.IsNotExist(err) {
+		t.Error("encrypted upload not removed")
+	}
+}
+
+func TestStoreMessageUndecrypted(t *testing.T) {
+	key, _ := testKey(t, "")
+	defer key.Destroy()
+	acc := &Account{Name: "alice", Dir: t.TempDir(), PrivKey: key}
+
+	// The second message with the same name gets a suffix
+	for _, want := range []string{"m1234567", "m1234567-1"} {
+		upload(t, acc, "m1234567", []byte("not for this key"))
+		stored, err := acc.StoreMessage("m1234567", "bob", testReceived)
+		if err == nil {
+			t.Error("storing an undecryptable message succeeded")
+		}
+		if stored != filepath.Join(undecryptedDir, want) {
+			t.Errorf("stored as %q, want %q", stored, filepath.Join(undecryptedDir, want))
+		}
+		if content, _ := os.ReadFile(acc.StoredPath(stored)); string(content) != "not for this key" {
+			t.Errorf("kept %q", content)
+		}
+	}
+	if names := readDir(t, acc.Dir); len(names) != 1 || names[0] != undecryptedDir {
+		t.Errorf("upload directory holds %q", names)
+	}
+}
+
+func TestStoreMessageDecryptedMaildir(t *testing.T) {
+	key, encrypted := testKey(t, "Subject: Hi\n\nHello\n")
+	defer key.Destroy()
+	root := t.TempDir()
+	acc := &Account{Name: "alice", Dir: root, PrivKey: key, Maildir: filepath.Join(root, "Maildir")}
+	if err := InitMaildir(acc.Maildir); err != nil {
+		t.Fatal(err)
+	}
+	upload(t, acc, "m1234567", encrypted)
+
+	stored, err := acc.StoreMessage("m1234567", "bob", testReceived)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := os.ReadFile(acc.StoredPath(stored))
+	want := "X-OC-Received: Wed, 01 May 2024 12:00:00 +0000\nX-OC-Username: bob\nSubject: Hi\n\nHello\n"
+	if string(content) != want {
+		t.Errorf("delivered %q, want %q", content, want)
+	}
+}
@@ -0,0 +1,84 @@
+// Package ocstore writes the storage of oc_server: uploaded files under
+// safe and unique names, the storage limits of an account, the accounts
+// file and the delivery of relayed messages to a Maildir.
+package ocstore
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxFilenameLength keeps stored names well below file system limits.
+const maxFilenameLength = 100
+
+// SanitizeFilename reduces a client supplied name to its last path element
+// made of letters, digits, '.', '-' and '_'. Names which are empty, hidden
+// or reserved on Windows are replaced or prefixed.
+func SanitizeFilename(name string) string {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+
+	var b strings.Builder
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '.', c == '-', c == '_':
+			b.WriteRune(c)
+		default:
+			b.WriteRune('_')
+		}
+	}
+
+	safe := strings.TrimLeft(b.String(), ".")
+	safe = strings.TrimRight(safe, ". ")
+	if len(safe) > maxFilenameLength {
+		ext := filepath.Ext(safe)
+		if len(ext) > 10 {
+			ext = ""
+		}
+		safe = safe[:maxFilenameLength-len(ext)] + ext
+	}
+	if safe == "" {
+		safe = "file"
+	}
+
+	base := strings.ToUpper(strings.SplitN(safe, ".", 2)[0])
+	switch base {
+	case "CON", "PRN", "AUX", "NUL",
+		"COM1", "COM2", "COM3", "COM4", "COM5", "COM6", "COM7", "COM8", "COM9",
+		"LPT1", "LPT2", "LPT3", "LPT4", "LPT5", "LPT6", "LPT7", "LPT8", "LPT9":
+		safe = "_" + safe
+	}
+	return safe
+}
+
+// CreateUniqueFile creates name in dir. If the name is taken, a suffix
+// -1, -2, ... is added before the extension. It returns the open file and
+// the name it was stored under.
+func CreateUniqueFile(dir, name string) (*os.File, string, error) {
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+
+	candidate := name
+	for i := 1; i <= 1000; i++ {
+		path := filepath.Join(dir, candidate)
+		if filepath.Dir(path) != filepath.Clean(dir) {
+			return nil, "", fmt.Errorf("file name %q leaves the storage directory", candidate)
+		}
+
+		dst, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			return dst, candidate, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, "", err
+		}
+		candidate = fmt.Sprintf("%s-%d%s", stem, i, ext)
+	}
+	return nil, "", fmt.Errorf("no free file name for %q", name)
+}
@@ -0,0 +1,96 @@
+package ocstore
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"report.pdf", "report.pdf"},
+		{"../../etc/passwd", "passwd"},
+		{"..\\..\\boot.ini", "boot.ini"},
+		{"/absolute/path.txt", "path.txt"},
+		{"dir/", "file"},
+		{"..", "file"},
+		{"", "file"},
+		{".hidden", "hidden"},
+		{"trailing...", "trailing"},
+		{"spaces and ümlauts.txt", "spaces_and__mlauts.txt"},
+		{"a\x00b", "a_b"},
+		{"CON", "_CON"},
+		{"con.txt", "_con.txt"},
+		{"Lpt1.tar.gz", "_Lpt1.tar.gz"},
+		{"CONSOLE.txt", "CONSOLE.txt"},
+		{"COM10", "COM10"},
+		{strings.Repeat("a", 200) + ".txt", strings.Repeat("a", 96) + ".txt"},
+		{strings.Repeat("a", 200) + "." + strings.Repeat("b", 20), strings.Repeat("a", 100)},
+	}
+	for _, test := range tests {
+		if got := SanitizeFilename(test.name); got != test.want {
+			t.Errorf("SanitizeFilename(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCreateUniqueFile(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, want := range []string{"a.txt", "a-1.txt", "a-2.txt"} {
+		file, name, err := CreateUniqueFile(dir, "a.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+		if name != want {
+			t.Errorf("got %q, want %q", name, want)
+		}
+	}
+
+	file, name, err := CreateUniqueFile(dir, "noext")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	if file, name, err = CreateUniqueFile(dir, "noext"); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	if name != "noext-1" {
+		t.Errorf("got %q, want noext-1", name)
+	}
+
+	// An existing file is never truncated
+	if err := os.WriteFile(filepath.Join(dir, "keep"), []byte("content"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if file, _, err = CreateUniqueFile(dir, "keep"); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	if content, _ := os.ReadFile(filepath.Join(dir, "keep")); string(content) != "content" {
+		t.Errorf("existing file changed to %q", content)
+	}
+}
+
+func TestCreateUniqueFileEscapes(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "store")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"../escaped", "sub/file", "..", "."} {
+		if file, _, err := CreateUniqueFile(dir, name); err == nil {
+			file.Close()
+			t.Errorf("CreateUniqueFile(%q) succeeded", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "..", "escaped")); err == nil {
+		t.Error("file created outside of the storage directory")
+	}
+}
@@ -0,0 +1,153 @@
+package ocstore
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/706f6c6c7578/oc/ocdisk"
+)
+
+// Limits are the storage limits for an upload to an account.
+type Limits struct {
+	Quota      int64    // bytes of the account, 0 means unlimited
+	Dirs       []string // directories of the account, the first gets the upload
+	TotalQuota int64    // bytes of all accounts, 0 means unlimited
+	AllDirs    []string // directories of all accounts
+	MinFree    int64    // bytes of free disk space to keep, 0 means no check
+	MaxUpload  int64    // bytes of a single upload, 0 means unlimited
+}
+
+// Room returns the number of bytes the account may still store, or -1 if
+// there is no limit. If the room is limited, reason describes the
+// tightest limit.
+func (l Limits) Room() (int64, string, error) {
+	room, reason := int64(-1), ""
+	limit := func(r int64, why string) {
+		if r < 0 {
+			r = 0
+		}
+		if room < 0 || r < room {
+			room, reason = r, why
+		}
+	}
+
+	if l.Quota > 0 {
+		used, err := DirsSize(l.Dirs)
+		if err != nil {
+			return 0, "", err
+		}
+		limit(l.Quota-used, "Storage quota exceeded")
+	}
+
+	if l.TotalQuota > 0 {
+		used, err := DirsSize(l.AllDirs)
+		if err != nil {
+			return 0, "", err
+		}
+		limit(l.TotalQuota-used, "Server storage quota exceeded")
+	}
+
+	if l.MinFree > 0 && len(l.Dirs) > 0 {
+		free, err := ocdisk.Free(l.Dirs[0])
+		if err != nil && !errors.Is(err, ocdisk.ErrUnsupported) {
+			return 0, "", err
+		}
+		if err == nil {
+			limit(int64(free)-l.MinFree, "Not enough free disk space")
+		}
+	}
+
+	return room, reason, nil
+}
+
+// Upload returns the most bytes an upload may have, or -1 if there is no
+// limit, with the status and reason for an upload which has more: 413
+// Request Entity Too Large if the maximum upload size is the tighter
+// limit, 507 Insufficient Storage if the storage is.
+func (l Limits) Upload() (int64, int, string, error) {
+	room, reason, err := l.Room()
+	if err != nil {
+		return 0, 0, "", err
+	}
+	if l.MaxUpload > 0 && (room < 0 || l.MaxUpload <= room) {
+		return l.MaxUpload, http.StatusRequestEntityTooLarge, fmt.Sprintf("File too large, the limit is %d bytes", l.MaxUpload), nil
+	}
+	return room, http.StatusInsufficientStorage, reason, nil
+}
+
+// ParseSize parses a size in bytes, with an optional K, M or G suffix.
+func ParseSize(s string) (int64, error) {
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		multiplier = 1024
+	case strings.HasSuffix(s, "M"):
+		multiplier = 1024 * 1024
+	case strings.HasSuffix(s, "G"):
+		multiplier = 1024 * 1024 * 1024
+	}
+	if multiplier > 1 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * multiplier, nil
+}
+
+// DirsSize returns the total size of the files below dirs. Directories
+// which are listed twice, or lie below another listed directory, are
+// counted once.
+func DirsSize(dirs []string) (int64, error) {
+	var size int64
+	for i, dir := range dirs {
+		counted := false
+		for j, other := range dirs {
+			if isBelow(dir, other) && (!isBelow(other, dir) || j < i) {
+				counted = true
+				break
+			}
+		}
+		if counted {
+			continue
+		}
+		n, err := dirSize(dir)
+		if err != nil {
+			return 0, err
+		}
+		size += n
+	}
+	return size, nil
+}
+
+// isBelow reports whether dir is parent or lies below it.
+func isBelow(dir, parent string) bool {
+	rel, err := filepath.Rel(parent, dir)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// dirSize returns the total size of the files below dir.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,172 @@
+package ocstore
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/706f6c6c7578/oc/ocdisk"
+)
+
+// writeFile creates path with size bytes, and the directories above it.
+func writeFile(t *testing.T, path string, size int) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, make([]byte, size), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int64
+		ok   bool
+	}{
+		{"0", 0, true},
+		{"100", 100, true},
+		{"1K", 1024, true},
+		{"100M", 100 * 1024 * 1024, true},
+		{"2G", 2 * 1024 * 1024 * 1024, true},
+		{"", 0, false},
+		{"K", 0, false},
+		{"-1", 0, false},
+		{"1.5M", 0, false},
+		{"1T", 0, false},
+		{"1k", 0, false},
+	}
+	for _, test := range tests {
+		got, err := ParseSize(test.s)
+		if (err == nil) != test.ok || got != test.want {
+			t.Errorf("ParseSize(%q) = %d, %v, want %d, ok %v", test.s, got, err, test.want, test.ok)
+		}
+	}
+}
+
+func TestIsBelow(t *testing.T) {
+	tests := []struct {
+		dir, parent string
+		want        bool
+	}{
+		{"/a", "/a", true},
+		{"/a/b", "/a", true},
+		{"/a/b/../c", "/a", true},
+		{"/a/..b", "/a", true},
+		{"/ab", "/a", false},
+		{"/a", "/a/b", false},
+		{"/b", "/a", false},
+	}
+	for _, test := range tests {
+		dir, parent := filepath.FromSlash(test.dir), filepath.FromSlash(test.parent)
+		if got := isBelow(dir, parent); got != test.want {
+			t.Errorf("isBelow(%q, %q) = %v, want %v", dir, parent, got, test.want)
+		}
+	}
+}
+
+func TestDirsSize(t *testing.T) {
+	root := t.TempDir()
+	a, b := filepath.Join(root, "a"), filepath.Join(root, "b")
+	writeFile(t, filepath.Join(a, "file"), 100)
+	writeFile(t, filepath.Join(a, "sub", "deeper", "file"), 10)
+	writeFile(t, filepath.Join(b, "file"), 1000)
+
+	tests := []struct {
+		dirs []string
+		want int64
+	}{
+		{nil, 0},
+		{[]string{a}, 110},
+		{[]string{a, a}, 110},
+		{[]string{a, filepath.Join(a, "sub")}, 110},
+		{[]string{filepath.Join(a, "sub"), a}, 110},
+		{[]string{a, b}, 1110},
+		{[]string{root, a, b}, 1110},
+	}
+	for _, test := range tests {
+		got, err := DirsSize(test.dirs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("DirsSize(%q) = %d, want %d", test.dirs, got, test.want)
+		}
+	}
+
+	if _, err := DirsSize([]string{filepath.Join(root, "missing")}); err == nil {
+		t.Error("DirsSize of a missing directory succeeded")
+	}
+}
+
+func TestUploadLimits(t *testing.T) {
+	root := t.TempDir()
+	a, b := filepath.Join(root, "a"), filepath.Join(root, "b")
+	writeFile(t, filepath.Join(a, "file"), 100)
+	writeFile(t, filepath.Join(b, "file"), 50)
+	all := []string{a, b}
+
+	tests := []struct {
+		name   string
+		limits Limits
+		room   int64
+		limit  int64
+		status int
+		reason string
+	}{
+		{"unlimited", Limits{Dirs: []string{a}},
+			-1, -1, http.StatusInsufficientStorage, ""},
+		{"max upload only", Limits{Dirs: []string{a}, MaxUpload: 10},
+			-1, 10, http.StatusRequestEntityTooLarge, "File too large, the limit is 10 bytes"},
+		{"quota full", Limits{Dirs: []string{a}, Quota: 100, MaxUpload: 10},
+			0, 0, http.StatusInsufficientStorage, "Storage quota exceeded"},
+		{"quota exceeded", Limits{Dirs: []string{a}, Quota: 90},
+			0, 0, http.StatusInsufficientStorage, "Storage quota exceeded"},
+		{"max upload equals room", Limits{Dirs: []string{a}, Quota: 150, MaxUpload: 50},
+			50, 50, http.StatusRequestEntityTooLarge, "File too large, the limit is 50 bytes"},
+		{"max upload above room", Limits{Dirs: []string{a}, Quota: 150, MaxUpload: 51},
+			50, 50, http.StatusInsufficientStorage, "Storage quota exceeded"},
+		{"account quota tighter", Limits{Dirs: []string{a}, Quota: 120, AllDirs: all, TotalQuota: 200},
+			20, 20, http.StatusInsufficientStorage, "Storage quota exceeded"},
+		{"server quota tighter", Limits{Dirs: []string{a}, Quota: 120, AllDirs: all, TotalQuota: 160},
+			10, 10, http.StatusInsufficientStorage, "Server storage quota exceeded"},
+		{"server quota full", Limits{Dirs: []string{a}, AllDirs: all, TotalQuota: 150, MaxUpload: 10},
+			0, 0, http.StatusInsufficientStorage, "Server storage quota exceeded"},
+	}
+	for _, test := range tests {
+		room, _, err := test.limits.Room()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if room != test.room {
+			t.Errorf("%s: room %d, want %d", test.name, room, test.room)
+		}
+
+		limit, status, reason, err := test.limits.Upload()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if limit != test.limit || status != test.status || reason != test.reason {
+			t.Errorf("%s: upload limit %d, %d %q, want %d, %d %q", test.name, limit, status, reason, test.limit, test.status, test.reason)
+		}
+	}
+}
+
+func TestMinFree(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := ocdisk.Free(dir); errors.Is(err, ocdisk.ErrUnsupported) {
+		t.Skip(err)
+	}
+
+	limits := Limits{Dirs: []string{dir}, MinFree: 1 << 62, MaxUpload: 10}
+	limit, status, reason, err := limits.Upload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limit != 0 || status != http.StatusInsufficientStorage || reason != "Not enough free disk space" {
+		t.Errorf("got %d, %d %q, want no room for lack of disk space", limit, status, reason)
+	}
+}
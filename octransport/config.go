@@ -0,0 +1,147 @@
+package octransport
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Environment variables read by Load. They override the config file and
+// are overridden by flags.
+const (
+	EnvConfig   = "OC_TRANSPORT_CONFIG"
+	EnvProxy    = "OC_PROXY"
+	EnvUsername = "OC_PROXY_USER"
+	EnvPassword = "OC_PROXY_PASS"
+	EnvDirect   = "OC_DIRECT"
+	EnvIsolate  = "OC_ISOLATE"
+)
+
+// Flags holds the transport flags of a program.
+type Flags struct {
+	fs         *flag.FlagSet
+	configFile string
+	config     Config
+}
+
+// RegisterFlags adds -proxy, -proxy-user, -proxy-pass, -direct, -isolate
+// and -transport-config to fs. After fs is parsed, Load returns the
+// resulting configuration.
+func RegisterFlags(fs *flag.FlagSet) *Flags {
+	f := &Flags{fs: fs}
+	fs.StringVar(&f.configFile, "transport-config", "", "Transport config file (env "+EnvConfig+")")
+	fs.StringVar(&f.config.Proxy, "proxy", DefaultProxy, "SOCKS5 proxy, as host:port, socks5://host:port or unix:/path (env "+EnvProxy+")")
+	fs.StringVar(&f.config.Username, "proxy-user", "", "SOCKS5 proxy username (env "+EnvUsername+")")
+	fs.StringVar(&f.config.Password, "proxy-pass", "", "SOCKS5 proxy password (env "+EnvPassword+")")
+	fs.BoolVar(&f.config.Direct, "direct", false, "Connect to non-onion destinations without the proxy (env "+EnvDirect+")")
+	fs.StringVar(&f.config.Isolation, "isolate", IsolateMessage, "Tor stream isolation: message, destination or none (env "+EnvIsolate+")")
+	return f
+}
+
+// Load merges the defaults, the config file, the environment and the
+// flags set on the command line, in that order.
+func (f *Flags) Load() (Config, error) {
+	config := Default()
+
+	set := make(map[string]bool)
+	f.fs.Visit(func(fl *flag.Flag) { set[fl.Name] = true })
+
+	configFile := os.Getenv(EnvConfig)
+	if set["transport-config"] {
+		configFile = f.configFile
+	}
+	if configFile != "" {
+		if err := readConfigFile(configFile, &config); err != nil {
+			return config, err
+		}
+	}
+
+	if v := os.Getenv(EnvProxy); v != "" {
+		config.Proxy = v
+	}
+	if v := os.Getenv(EnvUsername); v != "" {
+		config.Username = v
+	}
+	if v := os.Getenv(EnvPassword); v != "" {
+		config.Password = v
+	}
+	if v := os.Getenv(EnvDirect); v != "" {
+		direct, err := strconv.ParseBool(v)
+		if err != nil {
+			return config, fmt.Errorf("%s: %v", EnvDirect, err)
+		}
+		config.Direct = direct
+	}
+	if v := os.Getenv(EnvIsolate); v != "" {
+		config.Isolation = v
+	}
+
+	if set["proxy"] {
+		config.Proxy = f.config.Proxy
+	}
+	if set["proxy-user"] {
+		config.Username = f.config.Username
+	}
+	if set["proxy-pass"] {
+		config.Password = f.config.Password
+	}
+	if set["direct"] {
+		config.Direct = f.config.Direct
+	}
+	if set["isolate"] {
+		config.Isolation = f.config.Isolation
+	}
+
+	if _, _, _, err := parseProxy(config.Proxy); err != nil {
+		return config, err
+	}
+	return config, checkIsolation(config.Isolation)
+}
+
+// readConfigFile reads "key value" lines, with the keys proxy, proxy-user,
+// proxy-pass, direct and isolate. Lines starting with # are comments.
+func readConfigFile(filename string, config *Config) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.Fields(line)
+		if len(parts) != 2 {
+			return fmt.Errorf("%s:%d: expected key value", filename, lineNumber)
+		}
+
+		switch parts[0] {
+		case "proxy":
+			config.Proxy = parts[1]
+		case "proxy-user":
+			config.Username = parts[1]
+		case "proxy-pass":
+			config.Password = parts[1]
+		case "direct":
+			direct, err := strconv.ParseBool(parts[1])
+			if err != nil {
+				return fmt.Errorf("%s:%d: %v", filename, lineNumber, err)
+			}
+			config.Direct = direct
+		case "isolate":
+			config.Isolation = parts[1]
+		default:
+			return fmt.Errorf("%s:%d: unknown key %s", filename, lineNumber, parts[0])
+		}
+	}
+	return scanner.Err()
+}
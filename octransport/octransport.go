@@ -0,0 +1,206 @@
+// Package octransport is the network layer shared by the Onion Courier
+// programs. Connections go through a SOCKS5 proxy, normally Tor, reached
+// over TCP or a Unix socket. In direct mode destinations outside of Tor,
+// like clearnet gateways, are dialed without the proxy.
+package octransport
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/proxy"
+)
+
+// DefaultProxy is the address of a local Tor SOCKS port.
+const DefaultProxy = "127.0.0.1:9050"
+
+// Stream isolation modes. Tor keeps streams with different SOCKS
+// credentials on different circuits (IsolateSOCKSAuth), so every message
+// or every destination gets its own credentials.
+const (
+	IsolateMessage     = "message"
+	IsolateDestination = "destination"
+	IsolateNone        = "none"
+)
+
+// isolationSalt makes the credentials of a destination differ between
+// program runs.
+var isolationSalt = func() []byte {
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		panic(err)
+	}
+	return salt
+}()
+
+// Config describes how to reach a destination.
+type Config struct {
+	// Proxy is the SOCKS5 proxy, as host:port, socks5://host:port or
+	// unix:/path/to/socket.
+	Proxy string
+	// Username and Password are sent to the proxy, if set.
+	Username string
+	Password string
+	// Direct dials destinations which are not .onion addresses without
+	// the proxy.
+	Direct bool
+	// Isolation is one of IsolateMessage, IsolateDestination or
+	// IsolateNone. It has no effect if the proxy has credentials, in
+	// Username and Password or in a socks5:// URL.
+	Isolation string
+}
+
+// Default returns the configuration for a local Tor.
+func Default() Config {
+	return Config{Proxy: DefaultProxy, Isolation: IsolateMessage}
+}
+
+// ForMessage returns the configuration for sending one message to
+// destination, with SOCKS credentials chosen by the isolation mode.
+func (c Config) ForMessage(destination string) Config {
+	if c.hasProxyAuth() {
+		return c
+	}
+
+	switch c.Isolation {
+	case IsolateNone:
+		return c
+	case IsolateDestination:
+		mac := hmac.New(sha256.New, isolationSalt)
+		mac.Write([]byte(strings.ToLower(destination)))
+		token := hex.EncodeToString(mac.Sum(nil))
+		c.Username, c.Password = "oc-"+token[:16], token[16:48]
+	default:
+		token := make([]byte, 24)
+		if _, err := rand.Read(token); err != nil {
+			panic(err)
+		}
+		encoded := hex.EncodeToString(token)
+		c.Username, c.Password = "oc-"+encoded[:16], encoded[16:]
+	}
+	return c
+}
+
+// IsDirect reports whether address, a host or host:port, is dialed
+// without the proxy.
+func (c Config) IsDirect(address string) bool {
+	host := address
+	if h, _, err := net.SplitHostPort(address); err == nil {
+		host = h
+	}
+	// A fully qualified name like "abc.onion." is still an onion address
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	return c.Direct && !strings.HasSuffix(host, ".onion")
+}
+
+// Dial connects to address, through the proxy unless the address is
+// dialed directly.
+func (c Config) Dial(network, address string) (net.Conn, error) {
+	return c.DialContext(context.Background(), network, address)
+}
+
+// DialContext is Dial with a context.
+func (c Config) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if c.IsDirect(address) {
+		var d net.Dialer
+		return d.DialContext(ctx, network, address)
+	}
+
+	dialer, err := c.socksDialer()
+	if err != nil {
+		return nil, err
+	}
+	return dialer.DialContext(ctx, network, address)
+}
+
+// HTTPClient returns an HTTP client which connects through Dial. Its
+// connections are never reused, so use ForMessage first to get a client
+// per message.
+func (c Config) HTTPClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:       c.DialContext,
+			DisableKeepAlives: true,
+		},
+	}
+}
+
+// Describe names the route to address, for messages to the user.
+func (c Config) Describe(address string) string {
+	if c.IsDirect(address) {
+		return "Using direct connection"
+	}
+	return "Using Tor network"
+}
+
+// hasProxyAuth reports whether credentials for the proxy are configured.
+func (c Config) hasProxyAuth() bool {
+	if c.Username != "" || c.Password != "" {
+		return true
+	}
+	_, _, user, err := parseProxy(c.Proxy)
+	return err == nil && user != nil
+}
+
+func (c Config) socksDialer() (proxy.ContextDialer, error) {
+	network, address, user, err := parseProxy(c.Proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	var auth *proxy.Auth
+	if c.Username != "" || c.Password != "" {
+		auth = &proxy.Auth{User: c.Username, Password: c.Password}
+	} else if user != nil {
+		password, _ := user.Password()
+		auth = &proxy.Auth{User: user.Username(), Password: password}
+	}
+
+	dialer, err := proxy.SOCKS5(network, address, auth, proxy.Direct)
+	if err != nil {
+		return nil, fmt.Errorf("can't connect to the SOCKS5 proxy: %v", err)
+	}
+	return dialer.(proxy.ContextDialer), nil
+}
+
+func checkIsolation(isolation string) error {
+	switch isolation {
+	case IsolateMessage, IsolateDestination, IsolateNone:
+		return nil
+	}
+	return fmt.Errorf("invalid isolation %q, use %s, %s or %s", isolation, IsolateMessage, IsolateDestination, IsolateNone)
+}
+
+// parseProxy splits a proxy setting into network and address, along with
+// credentials given in a socks5:// URL.
+func parseProxy(s string) (network, address string, user *url.Userinfo, err error) {
+	switch {
+	case s == "":
+		return "tcp", DefaultProxy, nil, nil
+	case strings.HasPrefix(s, "unix:"):
+		path := strings.TrimPrefix(strings.TrimPrefix(s, "unix:"), "//")
+		if path == "" {
+			return "", "", nil, fmt.Errorf("invalid proxy %q: missing socket path", s)
+		}
+		return "unix", path, nil, nil
+	case strings.Contains(s, "://"):
+		u, err := url.Parse(s)
+		if err != nil {
+			return "", "", nil, fmt.Errorf("invalid proxy %q: %v", s, err)
+		}
+		if u.Scheme != "socks5" && u.Scheme != "socks5h" {
+			return "", "", nil, fmt.Errorf("invalid proxy %q: only socks5 is supported", s)
+		}
+		return "tcp", u.Host, u.User, nil
+	default:
+		return "tcp", s, nil, nil
+	}
+}